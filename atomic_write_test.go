@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	defer syscall.Umask(syscall.Umask(0077))
+	tests := []struct {
+		name     string
+		existing os.FileMode
+		perm     os.FileMode
+	}{
+		{"new file", 0, 0600},
+		{"new file beyond the umask", 0, 0644},
+		{"tightens an existing file", 0666, 0600},
+		{"widens an existing file", 0600, 0644},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "state.json")
+			if tt.existing != 0 {
+				if err := os.WriteFile(path, []byte("old content that is longer"), tt.existing); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chmod(path, tt.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writeFileAtomic(path, []byte("new"), tt.perm); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil || string(data) != "new" {
+				t.Fatalf("content %q, %v, want %q", data, err, "new")
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != tt.perm {
+				t.Errorf("mode %v, want %v", info.Mode().Perm(), tt.perm)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+				t.Errorf("left %d files behind in %s", len(entries)-1, dir)
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomicMissingDir(t *testing.T) {
+	if err := writeFileAtomic(filepath.Join(t.TempDir(), "missing", "state.json"), []byte("new"), 0600); err == nil {
+		t.Fatal("writeFileAtomic() into a missing directory succeeded")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+/*
+Browser profiles:
+Chrome and Chromium keep one directory per profile under their user data
+directory, and list the profiles with their display names in its `Local State` file.
+When [dsidCookiePoller].cookiePath is not set, the poller reads the cookie database of
+the last used profile, of the profile named by browserProfile, or of every profile.
+*/
+
+type chromiumBrowser struct {
+	name string
+	// user data directory, relative to the user's config directory
+	dir string
+}
+
+// in the order they are searched
+var chromiumBrowsers = []chromiumBrowser{
+	{name: "chrome", dir: "google-chrome"},
+	{name: "chromium", dir: "chromium"},
+}
+
+func chromiumBrowserNames() []string {
+	var names []string
+	for _, b := range chromiumBrowsers {
+		names = append(names, b.name)
+	}
+	return names
+}
+
+type BrowserProfile struct {
+	Browser string
+	// display name, e.g. "Work"
+	Name string
+	// directory name, e.g. "Profile 1"
+	Dir        string
+	CookiePath string
+	LastUsed   bool
+}
+
+func (p BrowserProfile) String() string {
+	if p.Name == "" || p.Name == p.Dir {
+		return p.Browser + "/" + p.Dir
+	}
+	return fmt.Sprintf("%s/%s (%s)", p.Browser, p.Name, p.Dir)
+}
+
+// profiles with a cookie database of the given browser, or of every known browser when
+// browser is empty
+func discoverBrowserProfiles(configDir string, browser string) []BrowserProfile {
+	var profiles []BrowserProfile
+	for _, b := range chromiumBrowsers {
+		if browser != "" && b.name != browser {
+			continue
+		}
+		root := filepath.Join(configDir, b.dir)
+		var localState struct {
+			Profile struct {
+				InfoCache map[string]struct {
+					Name string `json:"name"`
+				} `json:"info_cache"`
+				LastUsed string `json:"last_used"`
+			} `json:"profile"`
+		}
+		data, err := os.ReadFile(filepath.Join(root, "Local State"))
+		if err == nil {
+			err = json.Unmarshal(data, &localState)
+		}
+		if err != nil {
+			// not installed, or never started, or Local State of an unknown format
+			localState.Profile.InfoCache = map[string]struct {
+				Name string `json:"name"`
+			}{"Default": {}}
+		}
+		lastUsed := localState.Profile.LastUsed
+		if lastUsed == "" {
+			lastUsed = "Default"
+		}
+		for dir, info := range localState.Profile.InfoCache {
+			cookiePath := profileCookiePath(filepath.Join(root, dir))
+			if cookiePath == "" {
+				continue
+			}
+			profiles = append(profiles, BrowserProfile{
+				Browser:    b.name,
+				Name:       info.Name,
+				Dir:        dir,
+				CookiePath: cookiePath,
+				LastUsed:   dir == lastUsed,
+			})
+		}
+	}
+	sortBrowserProfiles(profiles)
+	return profiles
+}
+
+// Chrome 96 moved the cookie database into Network/
+func profileCookiePath(profileDir string) string {
+	for _, path := range []string{filepath.Join(profileDir, "Network", "Cookies"), filepath.Join(profileDir, "Cookies")} {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// by browser in search order, then by directory
+func sortBrowserProfiles(profiles []BrowserProfile) {
+	order := func(browser string) int {
+		for i, b := range chromiumBrowsers {
+			if b.name == browser {
+				return i
+			}
+		}
+		return len(chromiumBrowsers)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		if profiles[i].Browser != profiles[j].Browser {
+			return order(profiles[i].Browser) < order(profiles[j].Browser)
+		}
+		return profiles[i].Dir < profiles[j].Dir
+	})
+}
+
+// the profiles the poller reads: every one, the one named, or the last used one of the
+// first browser that has profiles
+func selectBrowserProfiles(profiles []BrowserProfile, name string, all bool) ([]BrowserProfile, error) {
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("no browser profiles with a cookie database found")
+	}
+	if all {
+		return profiles, nil
+	}
+	if name != "" {
+		for _, p := range profiles {
+			if strings.EqualFold(p.Name, name) || p.Dir == name {
+				return []BrowserProfile{p}, nil
+			}
+		}
+		var known []string
+		for _, p := range profiles {
+			known = append(known, p.String())
+		}
+		return nil, fmt.Errorf("no browser profile named %q, found %s", name, strings.Join(known, ", "))
+	}
+	for _, p := range profiles {
+		if p.LastUsed {
+			return []BrowserProfile{p}, nil
+		}
+	}
+	return profiles[:1], nil
+}
+
+// where the poller reads cookies from: cookiePath when set, otherwise the discovered
+// browser profiles
+func (c DsidCookiePollerConfig) ResolveCookieSources() ([]BrowserProfile, error) {
+	if c.CookiePath != "" {
+		browser := c.Browser
+		if browser == "" {
+			browser = "chrome"
+		}
+		dir := filepath.Dir(c.CookiePath)
+		if filepath.Base(dir) == "Network" {
+			dir = filepath.Dir(dir)
+		}
+		return []BrowserProfile{{Browser: browser, Dir: filepath.Base(dir), CookiePath: c.CookiePath}}, nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	return selectBrowserProfiles(discoverBrowserProfiles(configDir, c.Browser), c.BrowserProfile, c.AllProfiles)
+}
+
+// every profile found, marking the ones in sources
+func printBrowserProfiles(w io.Writer, config DsidCookiePollerConfig, sources []BrowserProfile) error {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return err
+	}
+	profiles := discoverBrowserProfiles(configDir, config.Browser)
+	if len(profiles) == 0 {
+		fmt.Fprintf(w, "no browser profiles found in %s\n", configDir)
+	}
+	for _, p := range profiles {
+		marker := " "
+		if slices.ContainsFunc(sources, func(s BrowserProfile) bool { return s.CookiePath == p.CookiePath }) {
+			marker = "*"
+		}
+		lastUsed := ""
+		if p.LastUsed {
+			lastUsed = "  (last used)"
+		}
+		fmt.Fprintf(w, "%s %-9s %-20s %-12s %s%s\n", marker, p.Browser, orNone(p.Name), p.Dir, p.CookiePath, lastUsed)
+	}
+	if config.CookiePath != "" {
+		fmt.Fprintf(w, "reading %s, set by cookiePath\n", config.CookiePath)
+	}
+	return nil
+}
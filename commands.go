@@ -0,0 +1,742 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const programName = "go-openconnect-monitor"
+
+type Command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []*Command{
+	{name: "poll", summary: "poll the browser cookie database and publish the DSID", run: runPoll},
+	{name: "manage", summary: "run and supervise openconnect (needs root)", run: runManage},
+	{name: "status", summary: "show the state of the running manager", run: runStatus},
+	{name: "reconnect", summary: "ask the running manager to restart openconnect", run: runReconnect},
+	{name: "profile", summary: "list VPN profiles or switch the running manager to another one", run: runProfile},
+	{name: "check-config", summary: "validate the configuration file and print the effective settings", run: runCheckConfig},
+	{name: "reset-network", summary: "restore DNS and routes from before openconnect started (needs root)", run: runResetNetwork},
+	{name: "helper", summary: "create the tun device and configure it for an unprivileged manager (needs root)", run: runHelper},
+	{name: "vpnc-script", summary: "configure the tunnel, run by openconnect as its --script", run: runVpncScript},
+	{name: "exec", summary: "run a program inside the VPN's network namespace (needs root)", run: runExec},
+	{name: "dsid", summary: "read, write or clear the stored DSID of a profile", run: runDSID},
+	{name: "history", summary: "show recent events from the running manager", run: runHistory},
+	{name: "dashboard", summary: "show a live view of the running manager", run: runDashboard},
+	{name: "version", summary: "print the version", run: runVersion},
+}
+
+// returned by a command when its flags could not be parsed, usage has already been printed
+var errUsage = errors.New("usage")
+
+func run(args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return 2
+	}
+
+	// the nix modules used to invoke us as `-mode=poll_cookies ...`
+	if strings.HasPrefix(args[0], "-") && !isHelpFlag(args[0]) {
+		translated, err := translateLegacyArgs(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", programName, err)
+			return 2
+		}
+		args = translated
+	}
+
+	name := args[0]
+	if name == "help" || isHelpFlag(name) {
+		if len(args) > 1 {
+			if cmd := findCommand(args[1]); cmd != nil {
+				return exitCode(cmd.run([]string{"-h"}))
+			}
+		}
+		printUsage()
+		return 0
+	}
+
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "%s: unknown command %q\n\n", programName, name)
+		printUsage()
+		return 2
+	}
+	if err := cmd.run(args[1:]); err != nil {
+		if !errors.Is(err, errUsage) && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "%s %s: %v\n", programName, cmd.name, err)
+		}
+		return exitCode(err)
+	}
+	return 0
+}
+
+func exitCode(err error) int {
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errUsage):
+		return 2
+	default:
+		return 1
+	}
+}
+
+func isHelpFlag(arg string) bool {
+	return arg == "-h" || arg == "-help" || arg == "--help"
+}
+
+func findCommand(name string) *Command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", programName)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun '%s help <command>' for the flags of a command\n", programName)
+}
+
+// map the old -mode flag onto the equivalent subcommand, rejecting unknown modes
+func translateLegacyArgs(args []string) ([]string, error) {
+	fs := flag.NewFlagSet(programName, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	mode := fs.String("mode", "", "deprecated, use a subcommand instead")
+	dsidPath := fs.String("dsid_path", ".dsid", "")
+	configPath := fs.String("config_path", "config.toml", "")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	var name string
+	switch *mode {
+	case "poll_cookies":
+		name = "poll"
+	case "manage_openconnect":
+		name = "manage"
+	case "":
+		return nil, errors.New("missing command, -mode is deprecated in favour of subcommands")
+	default:
+		return nil, fmt.Errorf("unknown mode %q, expected 'poll_cookies' or 'manage_openconnect'", *mode)
+	}
+	fmt.Fprintf(os.Stderr, "warning: -mode=%s is deprecated, use '%s %s'\n", *mode, programName, name)
+	return append([]string{name, "-dsid_path", *dsidPath, "-config_path", *configPath}, fs.Args()...), nil
+}
+
+func newFlagSet(name string, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "usage: %s %s [flags]\n\n%s\n", programName, name, description)
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(out, "\nflags:\n")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+func dsidPathFlag(fs *flag.FlagSet) *string {
+	return fs.String("dsid_path", ".dsid", "Path to file containing the DSID used for openconnect")
+}
+
+func configPathFlag(fs *flag.FlagSet) *string {
+	return fs.String("config_path", "config.toml", "Path to the TOML configuration file")
+}
+
+func configOverridesFlag(fs *flag.FlagSet) *stringList {
+	overrides := &stringList{}
+	fs.Var(overrides, "set", "Override a config key, as section.key=value (repeatable)")
+	return overrides
+}
+
+func controlSocketFlag(fs *flag.FlagSet) *string {
+	return fs.String("control_socket", defaultControlSocket, "Path to the manager's control socket")
+}
+
+func runPoll(args []string) error {
+	fs := newFlagSet("poll", "Polls the browser cookie database for the DSID cookie and writes it to the\nDSID file. Runs as the user so that cookies can be decrypted.")
+	dsidPath := dsidPathFlag(fs)
+	configPath := configPathFlag(fs)
+	overrides := configOverridesFlag(fs)
+	once := fs.Bool("once", false, "Read the cookie database once and exit, non-zero if that failed")
+	explain := fs.Bool("explain", false, "With -once, print what was found in the cookie database and why")
+	listProfiles := fs.Bool("browser_profiles", false, "List the browser profiles found and exit, * marks the ones read")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *explain && !*once {
+		fmt.Fprintf(fs.Output(), "-explain requires -once\n")
+		fs.Usage()
+		return errUsage
+	}
+
+	config, err := LoadConfig(*configPath, *overrides)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	sources, err := config.DsidCookiePoller.ResolveCookieSources()
+	if *listProfiles {
+		return printBrowserProfiles(os.Stdout, config.DsidCookiePoller, sources)
+	}
+	if err != nil {
+		return fmt.Errorf("finding the cookie database: %w", err)
+	}
+
+	dsidCookiePoller := NewDSIDCookiePoller(config.DsidCookiePoller, config.DsidStore, sources, config.ResolveProfiles(), *dsidPath)
+	if *once {
+		result := dsidCookiePoller.pollAndSave()
+		if *explain {
+			printPollResult(os.Stdout, result)
+		}
+		if !result.status.Healthy {
+			return errors.New(result.status.summary())
+		}
+		return nil
+	}
+	dsidCookiePoller.Start(time.Second*time.Duration(config.Controller.IntervalSeconds), time.Second*time.Duration(config.DsidCookiePoller.FallbackSeconds))
+	return nil
+}
+
+func runManage(args []string) error {
+	fs := newFlagSet("manage", "Starts openconnect with the most recent DSID and restarts it when the cookie\nchanges, is rejected, or health checks fail. Runs as root.")
+	dsidPath := dsidPathFlag(fs)
+	configPath := configPathFlag(fs)
+	overrides := configOverridesFlag(fs)
+	controlSocket := controlSocketFlag(fs)
+	controlGroup := fs.String("control_group", "", "Group allowed to use the control socket, besides the manager's user")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	config, err := LoadConfig(*configPath, *overrides)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	healthChecker := NewHealthChecker(config.HealthCheck, config.Namespace.active())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	profiles := config.ResolveProfiles()
+	activeProfile, _ := config.Profile(config.ActiveProfileName())
+	openConnectProcess := NewOpenConnectProcess(activeProfile, config.OpenConnect, ctx)
+	switch {
+	case config.Proxy.Enabled:
+		// the host is left alone, so there is nothing to restore
+		openConnectProcess.EnableProxy(proxyCommand(config.Proxy))
+		healthChecker.EnableProxy(proxyAddress(config.Proxy))
+		fmt.Printf("proxy mode, SOCKS5 proxy on %s\n", proxyAddress(config.Proxy))
+	case config.Unprivileged.Enabled:
+		// the helper configures the device and keeps the network snapshot
+		if os.Geteuid() == 0 {
+			fmt.Printf("warning: unprivileged.enabled is set but the manager is running as root\n")
+		}
+		command, err := vpncScriptCommand(*configPath, *overrides, config.Unprivileged.HelperSocket)
+		if err != nil {
+			return err
+		}
+		openConnectProcess.EnableVpncScript(command)
+		openConnectProcess.EnableInterface(config.Unprivileged.Interface)
+		openConnectProcess.EnableNetworkRestore(newHelperNetwork(config.Unprivileged.HelperSocket))
+	case config.VpncScript.Enabled || config.Namespace.Enabled:
+		// only our vpnc-script knows to move the device into the namespace
+		if config.Namespace.Enabled {
+			if err := createNetns(config.Namespace.Name); err != nil {
+				return fmt.Errorf("creating network namespace %s: %w", config.Namespace.Name, err)
+			}
+			openConnectProcess.EnableNamespace(config.Namespace.Name)
+		}
+		command, err := vpncScriptCommand(*configPath, *overrides, "")
+		if err != nil {
+			return err
+		}
+		openConnectProcess.EnableVpncScript(command)
+		fallthrough
+	default:
+		if config.NetworkRestore.Enabled {
+			openConnectProcess.EnableNetworkRestore(NewNetworkRestorer(config.NetworkRestore))
+		}
+	}
+	openDSIDStore, err := manageDSIDStore(config.DsidStore, *configPath, *overrides, *dsidPath)
+	if err != nil {
+		return err
+	}
+	controller := NewController(config.Controller, config.DsidTracker, *dsidPath, openDSIDStore, profiles, activeProfile.Name, healthChecker, openConnectProcess)
+	if config.KillSwitch.Enabled {
+		controller.EnableKillSwitch(NewKillSwitch(config.KillSwitch, config.Unprivileged.Interface))
+	}
+	if config.TunnelStats.Enabled {
+		controller.EnableTunnelStats(NewTunnelMonitor(config.TunnelStats, config.Namespace.active()))
+	}
+
+	configWatcher := NewConfigWatcher(*configPath)
+	configWatcher.Start()
+	controller.EnableReload(NewConfigLoader(*configPath, *overrides), config, configWatcher.Changes())
+	controller.EnablePreflight(config.Preflight)
+	controller.EnableDSIDValidation(config.DsidValidation, config.DsidCookiePoller.CookieName)
+	if config.NetworkEvents.Enabled {
+		networkMonitor := NewNetworkMonitor(config.NetworkEvents)
+		if err := networkMonitor.Start(); err != nil {
+			// not fatal, health checks still catch a dead tunnel eventually
+			fmt.Printf("not watching network changes: %v\n", err)
+		} else {
+			controller.EnableNetworkEvents(networkMonitor.Changes())
+		}
+	}
+	if config.Sleep.Enabled {
+		sleepMonitor := NewSleepMonitor(config.Sleep)
+		if err := sleepMonitor.Start(); err != nil {
+			fmt.Printf("not watching for suspend/resume: %v\n", err)
+		} else {
+			defer sleepMonitor.Close()
+			controller.EnableSleepEvents(sleepMonitor)
+		}
+	}
+
+	controlServer := NewControlServer(*controlSocket)
+	if *controlGroup != "" {
+		group, err := user.LookupGroup(*controlGroup)
+		if err != nil {
+			return fmt.Errorf("control socket group: %w", err)
+		}
+		gid, _ := strconv.Atoi(group.Gid)
+		controlServer.SetOwner(-1, gid, 0660)
+	}
+	controller.RegisterControlHandlers(controlServer)
+	if err := controlServer.Start(); err != nil {
+		return err
+	}
+	defer controlServer.Close()
+
+	shutdown, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	controller.Start(shutdown)
+	return nil
+}
+
+func runStatus(args []string) error {
+	fs := newFlagSet("status", "Shows the connection state reported by the running manager.")
+	controlSocket := controlSocketFlag(fs)
+	asJSON := fs.Bool("json", false, "Print the raw status as JSON")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	var report StatusReport
+	if err := controlCall(*controlSocket, "status", nil, &report); err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(report)
+	}
+	printStatus(os.Stdout, report)
+	return nil
+}
+
+func runReconnect(args []string) error {
+	fs := newFlagSet("reconnect", "Asks the running manager to stop openconnect and start it again with the\ncurrent DSID.")
+	controlSocket := controlSocketFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if err := controlCall(*controlSocket, "reconnect", nil, nil); err != nil {
+		return err
+	}
+	fmt.Println("reconnect requested")
+	return nil
+}
+
+func runProfile(args []string) error {
+	fs := newFlagSet("profile", "Without a name, lists the configured VPN profiles and marks the active one.\nWith a name, asks the running manager to switch to that profile.\n\nusage: "+programName+" profile [flags] [name]")
+	controlSocket := controlSocketFlag(fs)
+	asJSON := fs.Bool("json", false, "Print the profiles as JSON")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return errUsage
+	}
+
+	if fs.NArg() == 1 {
+		name := fs.Arg(0)
+		if err := controlCall(*controlSocket, "profile", map[string]string{"name": name}, nil); err != nil {
+			return err
+		}
+		fmt.Printf("switched to profile %s\n", name)
+		return nil
+	}
+
+	var profiles []ProfileStatus
+	if err := controlCall(*controlSocket, "profiles", nil, &profiles); err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(profiles)
+	}
+	printProfiles(os.Stdout, profiles)
+	return nil
+}
+
+func runCheckConfig(args []string) error {
+	fs := newFlagSet("check-config", "Loads and validates the configuration, then prints the effective settings\nwith defaults, OCMON_* environment variables and -set overrides applied.\nEach value is annotated with where it came from.")
+	configPath := configPathFlag(fs)
+	overrides := configOverridesFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	config, sources, err := NewConfigLoader(*configPath, *overrides).Load()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# %s is valid, effective configuration:\n\n%s", *configPath, config.Annotated(sources))
+	return nil
+}
+
+func runResetNetwork(args []string) error {
+	fs := newFlagSet("reset-network", "Restores /etc/resolv.conf and the routing table from the snapshot the manager\ntook before starting openconnect. Without a snapshot, or with -fallback,\nresolv.conf is overwritten with [networkRestore].fallbackNameservers. Also removes\nthe kill switch of a manager that didn't shut down cleanly. Runs as root.")
+	configPath := configPathFlag(fs)
+	overrides := configOverridesFlag(fs)
+	fallback := fs.Bool("fallback", false, "Ignore the snapshot and write the fallback nameservers")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	config, err := LoadConfig(*configPath, *overrides)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	// a kill switch left behind by a manager that didn't shut down cleanly
+	if config.KillSwitch.Enabled {
+		if err := NewKillSwitch(config.KillSwitch, "").lift(); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	network := NewNetworkRestorer(config.NetworkRestore)
+	snapshot, err := network.load()
+	if *fallback || err != nil {
+		if err != nil {
+			fmt.Printf("no snapshot to restore (%v), using fallback nameservers\n", err)
+		}
+		if err := network.resetResolvConf(); err != nil {
+			return err
+		}
+		fmt.Printf("wrote %s with nameservers %s\n", resolvConfPath, strings.Join(config.NetworkRestore.FallbackNameservers, ", "))
+		return nil
+	}
+
+	fmt.Printf("restoring the network as of %s\n", snapshot.TakenAt.Format(time.DateTime))
+	changes, err := network.restore()
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	if err == nil && len(changes) == 0 {
+		fmt.Println("the network already matches the snapshot")
+	}
+	return err
+}
+
+func runHelper(args []string) error {
+	fs := newFlagSet("helper", "Creates the persistent tun device [unprivileged].interface owned by\n[unprivileged].user, then configures it on behalf of openconnect running as\nthat user. Listens on [unprivileged].helperSocket. Runs as root.")
+	configPath := configPathFlag(fs)
+	overrides := configOverridesFlag(fs)
+	remove := fs.Bool("remove", false, "Remove the tun device and exit")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	config, err := LoadConfig(*configPath, *overrides)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	if *remove {
+		return removeTun(config.Unprivileged.Interface)
+	}
+	if !config.Unprivileged.Enabled {
+		return errors.New("unprivileged.enabled is not set")
+	}
+	helper, err := NewPrivilegedHelper(config)
+	if err != nil {
+		return err
+	}
+	server, err := helper.Start()
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	return nil
+}
+
+func runVpncScript(args []string) error {
+	fs := newFlagSet("vpnc-script", "Configures the tunnel device, routes and DNS from the environment variables\nopenconnect passes to its --script, applying the [vpncScript] split tunnel\nrules. The manager passes this command to openconnect when\n[vpncScript].enabled is set.")
+	configPath := configPathFlag(fs)
+	overrides := configOverridesFlag(fs)
+	helperSocket := fs.String("helper_socket", "", "Forward the environment to the privileged helper on this socket instead")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *helperSocket != "" {
+		return controlCall(*helperSocket, helperVpncScript, vpncEnvArgs(os.Environ()), nil)
+	}
+	config, _, err := NewConfigLoader(*configPath, *overrides).Load()
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	env, err := parseVpncEnv(os.Getenv)
+	if err != nil {
+		return err
+	}
+	return NewVpncScript(config.VpncScript, config.Namespace.active(), env).Run()
+}
+
+func runExec(args []string) error {
+	fs := newFlagSet("exec", "Runs a program inside [namespace].name, where the only route out is the VPN,\nwith the tunnel's nameservers as its resolv.conf. Started with sudo, the\nprogram runs as the invoking user. Runs as root.\n\nusage: "+programName+" exec [flags] [--] program [args...]")
+	configPath := configPathFlag(fs)
+	overrides := configOverridesFlag(fs)
+	runAs := fs.String("user", os.Getenv("SUDO_USER"), "User to run the program as, default the user that ran sudo")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	config, err := LoadConfig(*configPath, *overrides)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	if !config.Namespace.Enabled {
+		return errors.New("namespace.enabled is not set")
+	}
+	var account *user.User
+	if *runAs != "" {
+		account, err = user.Lookup(*runAs)
+	} else {
+		account, err = user.Current()
+	}
+	if err != nil {
+		return err
+	}
+	uid, _ := strconv.Atoi(account.Uid)
+	gid, _ := strconv.Atoi(account.Gid)
+	var groups []int
+	groupIds, _ := account.GroupIds()
+	for _, id := range groupIds {
+		if group, err := strconv.Atoi(id); err == nil {
+			groups = append(groups, group)
+		}
+	}
+	program, err := exec.LookPath(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	env := append(os.Environ(), "HOME="+account.HomeDir, "USER="+account.Username, "LOGNAME="+account.Username)
+	return execInNetns(config.Namespace.Name, program, fs.Args(), env, uid, gid, groups)
+}
+
+func runDSID(args []string) error {
+	fs := newFlagSet("dsid", "Reads, writes or clears the DSID of a profile in [dsidStore], as the poller\nstores it. Run as the user owning the store.\n\nusage: "+programName+" dsid [flags] get|set <dsid>|clear")
+	dsidPath := dsidPathFlag(fs)
+	configPath := configPathFlag(fs)
+	overrides := configOverridesFlag(fs)
+	profile := fs.String("profile", "", "Profile whose DSID to use, default the active one")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	config, _, err := NewConfigLoader(*configPath, *overrides).Load()
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	if *profile == "" {
+		*profile = config.ActiveProfileName()
+	}
+	if _, ok := config.Profile(*profile); !ok {
+		return fmt.Errorf("unknown profile %q", *profile)
+	}
+	store := NewDSIDStore(config.DsidStore, *dsidPath, *profile)
+	switch {
+	case fs.NArg() == 1 && fs.Arg(0) == "get":
+		dsid, err := store.ReadDSID()
+		if err != nil {
+			return err
+		}
+		fmt.Print(dsid)
+		return nil
+	case fs.NArg() == 2 && fs.Arg(0) == "set":
+		return store.WriteDSID(fs.Arg(1))
+	case fs.NArg() == 1 && fs.Arg(0) == "clear":
+		return clearDSID(store)
+	}
+	fs.Usage()
+	return errUsage
+}
+
+func clearDSID(store DSIDStore) error {
+	switch store := store.(type) {
+	case *DSIDFileReader:
+		return os.Remove(store.file)
+	case *keyringDSIDStore:
+		return store.remove()
+	case *secretServiceDSIDStore:
+		return store.remove()
+	}
+	return fmt.Errorf("cannot clear a %T", store)
+}
+
+// how the manager reads the DSIDs. As root it can't reach a user's keyring or secret
+// service itself, so it runs the dsid command as that user
+func manageDSIDStore(config DsidStoreConfig, configPath string, overrides []string, dsidPath string) (func(profile string) DSIDStore, error) {
+	if config.Backend == dsidStoreFile || os.Geteuid() != 0 {
+		return func(profile string) DSIDStore {
+			return NewDSIDStore(config, dsidPath, profile)
+		}, nil
+	}
+	if config.User == "" {
+		return nil, fmt.Errorf("dsidStore.user is required to read the %s as root", config.Backend)
+	}
+	account, err := user.Lookup(config.User)
+	if err != nil {
+		return nil, err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	if configPath, err = filepath.Abs(configPath); err != nil {
+		return nil, err
+	}
+	return func(profile string) DSIDStore {
+		command := []string{executable, "dsid", "-config_path=" + configPath}
+		for _, override := range overrides {
+			command = append(command, "-set", override)
+		}
+		command = append(command, "-profile="+profile, "get")
+		return newUserDSIDStore(command, account, pollerStatusPath(dsidPath))
+	}, nil
+}
+
+// the command line openconnect runs through /bin/sh for the vpnc-script subcommand
+func vpncScriptCommand(configPath string, overrides []string, helperSocket string) (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("locating %s for the vpnc-script: %w", programName, err)
+	}
+	configPath, err = filepath.Abs(configPath)
+	if err != nil {
+		return "", err
+	}
+	parts := []string{shellQuote(executable), "vpnc-script", "-config_path=" + shellQuote(configPath)}
+	for _, override := range overrides {
+		parts = append(parts, "-set", shellQuote(override))
+	}
+	if helperSocket != "" {
+		parts = append(parts, "-helper_socket="+shellQuote(helperSocket))
+	}
+	return strings.Join(parts, " "), nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func runHistory(args []string) error {
+	fs := newFlagSet("history", "Shows recent events (starts, stops, DSID changes, health check failures)\nrecorded by the running manager.")
+	controlSocket := controlSocketFlag(fs)
+	limit := fs.Int("n", 50, "Number of events to show, 0 for all retained events")
+	asJSON := fs.Bool("json", false, "Print the events as JSON")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	var events []Event
+	if err := controlCall(*controlSocket, "history", map[string]string{"n": strconv.Itoa(*limit)}, &events); err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(events)
+	}
+	printHistory(os.Stdout, events)
+	return nil
+}
+
+func runDashboard(args []string) error {
+	fs := newFlagSet("dashboard", "Shows a live view of the running manager: connection state, session expiry,\nhealth checks, tunnel traffic and recent events. Quit with ctrl-c.")
+	controlSocket := controlSocketFlag(fs)
+	interval := fs.Int("interval", 1, "Seconds between redraws")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		fmt.Fprintf(fs.Output(), "-interval must be greater than 0\n")
+		return errUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return NewDashboard(*controlSocket, time.Duration(*interval)*time.Second).Run(ctx)
+}
+
+func runVersion(args []string) error {
+	fs := newFlagSet("version", "Prints the version of this build.")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	fmt.Printf("%s %s\n", programName, version)
+	return nil
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
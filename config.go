@@ -1,61 +1,515 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
-	toml "github.com/pelletier/go-toml/v2"
+	"net"
+	"net/url"
 	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	toml "github.com/pelletier/go-toml/v2"
 )
 
 type Config struct {
-	Controller  ControllerConfig
-	DsidWriter  DsidWriterConfig
-	DsidCookiePoller  DsidCookiePollerConfig
-	HealthCheck HealthCheckConfig
-	OpenConnect OpenConnectConfig
-	Vpn         VPNConfig
+	Controller       ControllerConfig         `toml:"controller"`
+	DsidWriter       DsidWriterConfig         `toml:"dsidWriter"`
+	DsidStore        DsidStoreConfig          `toml:"dsidStore"`
+	DsidTracker      DsidTrackerConfig        `toml:"dsidTracker"`
+	DsidValidation   DsidValidationConfig     `toml:"dsidValidation"`
+	DsidCookiePoller DsidCookiePollerConfig   `toml:"dsidCookiePoller"`
+	HealthCheck      HealthCheckConfig        `toml:"healthCheck"`
+	OpenConnect      OpenConnectConfig        `toml:"openconnect"`
+	Preflight        PreflightConfig          `toml:"preflight"`
+	NetworkEvents    NetworkEventsConfig      `toml:"networkEvents"`
+	Sleep            SleepConfig              `toml:"sleep"`
+	NetworkRestore   NetworkRestoreConfig     `toml:"networkRestore"`
+	VpncScript       VpncScriptConfig         `toml:"vpncScript"`
+	Unprivileged     UnprivilegedConfig       `toml:"unprivileged"`
+	Namespace        NamespaceConfig          `toml:"namespace"`
+	Proxy            ProxyConfig              `toml:"proxy"`
+	KillSwitch       KillSwitchConfig         `toml:"killSwitch"`
+	TunnelStats      TunnelStatsConfig        `toml:"tunnelStats"`
+	Vpn              VPNConfig                `toml:"vpn"`
+	Profiles         map[string]ProfileConfig `toml:"profiles"`
 }
 
 type ControllerConfig struct {
-	IntervalSeconds               int
-	HealthCheckGracePeriodSeconds int
+	IntervalSeconds               int `toml:"intervalSeconds"`
+	HealthCheckGracePeriodSeconds int `toml:"healthCheckGracePeriodSeconds"`
 }
 
 type DsidCookiePollerConfig struct {
-	CookieName string
-	CookiePath string
-	CookieHost string
+	CookieName string `toml:"cookieName"`
+	// found in the browser's profiles when empty, see ResolveCookieSources
+	CookiePath string `toml:"cookiePath"`
+	CookieHost string `toml:"cookieHost"`
+	// chrome or chromium, empty to search both. Also picks the key the
+	// cookies are decrypted with
+	Browser string `toml:"browser"`
+	// display or directory name of the browser profile, empty for the last used one
+	BrowserProfile string `toml:"browserProfile"`
+	// read the cookies of every profile found
+	AllProfiles bool `toml:"allProfiles"`
+	// run through /bin/sh when the manager reports the published DSID rejected or expired
+	OnRejectedCommand string `toml:"onRejectedCommand"`
+	// the cookie database is read when it changes, and at this interval in case a
+	// change was missed
+	FallbackSeconds int `toml:"fallbackSeconds"`
 }
 
 type DsidWriterConfig struct {
-	IntervalSeconds int
+	IntervalSeconds int `toml:"intervalSeconds"`
+}
+
+type DsidStoreConfig struct {
+	// file, keyring or secret-service
+	Backend string `toml:"backend"`
+	// owner of the keyring or secret service, needed when the manager runs as root
+	User string `toml:"user"`
+}
+
+type DsidTrackerConfig struct {
+	// forget DSIDs not seen for this long, 0 to keep them until the size cap
+	TtlHours   int `toml:"ttlHours"`
+	MaxEntries int `toml:"maxEntries"`
+	// keeps rejected DSIDs (hashed) across restarts, empty to keep them in memory
+	StateFile string `toml:"stateFile"`
+}
+
+type DsidValidationConfig struct {
+	// ask the gateway whether a new DSID is valid before dropping a connected tunnel for it
+	Enabled        bool `toml:"enabled"`
+	TimeoutSeconds int  `toml:"timeoutSeconds"`
+	// how long to wait before asking again when the gateway gave no clear answer
+	RetrySeconds int  `toml:"retrySeconds"`
+	VerifyTLS    bool `toml:"verifyTLS"`
 }
 
 type HealthCheckConfig struct {
-	Host           string
-	Port           string
-	TimeoutSeconds int
+	Host           string `toml:"host"`
+	Port           string `toml:"port"`
+	TimeoutSeconds int    `toml:"timeoutSeconds"`
 }
 
 type OpenConnectConfig struct {
-	ExtraArgs                  string
-	Verbose                    bool
-	DryRun                     bool
-	ShutdownGracePeriodSeconds int
+	ExtraArgs                  string `toml:"extraArgs"`
+	Verbose                    bool   `toml:"verbose"`
+	DryRun                     bool   `toml:"dryRun"`
+	ShutdownGracePeriodSeconds int    `toml:"shutdownGracePeriodSeconds"`
+}
+
+type PreflightConfig struct {
+	Enabled          bool   `toml:"enabled"`
+	TimeoutSeconds   int    `toml:"timeoutSeconds"`
+	RetrySeconds     int    `toml:"retrySeconds"`
+	CaptivePortalUrl string `toml:"captivePortalUrl"`
+	VerifyTLS        bool   `toml:"verifyTLS"`
+}
+
+type NetworkEventsConfig struct {
+	Enabled              bool     `toml:"enabled"`
+	DebounceMilliseconds int      `toml:"debounceMilliseconds"`
+	IgnoreInterfaces     []string `toml:"ignoreInterfaces"`
+}
+
+type SleepConfig struct {
+	Enabled bool `toml:"enabled"`
+	// D-Bus address to listen on for logind signals, the system bus when empty
+	BusAddress string `toml:"busAddress"`
+}
+
+type NetworkRestoreConfig struct {
+	Enabled bool `toml:"enabled"`
+	// where the pre-connect snapshot is kept for reset-network
+	StateFile string `toml:"stateFile"`
+	// written to resolv.conf by reset-network when there is no snapshot
+	FallbackNameservers []string `toml:"fallbackNameservers"`
+}
+
+type VpncScriptConfig struct {
+	// run openconnect with this program as its --script instead of the system vpnc-script
+	Enabled bool `toml:"enabled"`
+	// subnets routed through the tunnel, replacing the server's split-include list
+	IncludeRoutes []string `toml:"includeRoutes"`
+	// subnets kept off the tunnel, in addition to the server's split-exclude list
+	ExcludeRoutes []string `toml:"excludeRoutes"`
+	// domains resolved through the tunnel, replacing the server's split DNS list
+	DnsDomains []string `toml:"dnsDomains"`
+}
+
+type UnprivilegedConfig struct {
+	// run openconnect as user on a tun device pre-created by the helper
+	Enabled bool   `toml:"enabled"`
+	User    string `toml:"user"`
+	// name of the persistent tun device
+	Interface    string `toml:"interface"`
+	HelperSocket string `toml:"helperSocket"`
+}
+
+type NamespaceConfig struct {
+	// confine the tunnel to a network namespace, see the exec command
+	Enabled bool   `toml:"enabled"`
+	Name    string `toml:"name"`
+}
+
+// the namespace the tunnel lives in, empty when it is on the host
+func (n NamespaceConfig) active() string {
+	if !n.Enabled {
+		return ""
+	}
+	return n.Name
+}
+
+type ProxyConfig struct {
+	// give openconnect a userspace network stack with --script-tun instead of a tun device
+	Enabled bool `toml:"enabled"`
+	// ocproxy or tunsocks
+	Program   string `toml:"program"`
+	SocksPort int    `toml:"socksPort"`
+	// 0 for none, tunsocks only
+	HttpPort int `toml:"httpPort"`
+}
+
+type TunnelStatsConfig struct {
+	// watch the tun device's counters as a passive health check
+	Enabled bool `toml:"enabled"`
+	// the tunnel is unhealthy after sending without receiving anything for this long
+	StallSeconds int `toml:"stallSeconds"`
+}
+
+type KillSwitchConfig struct {
+	// drop traffic outside the tunnel while it is not connected
+	Enabled bool `toml:"enabled"`
+	// let DNS through to the host's nameservers, openconnect has to resolve the gateway
+	// to reconnect
+	AllowDns bool `toml:"allowDns"`
+	// e.g. the LAN, reachable at all times
+	AllowSubnets []string `toml:"allowSubnets"`
 }
 
 type VPNConfig struct {
-	Url string
+	Url      string `toml:"url"`
+	Protocol string `toml:"protocol"`
+	// alternative gateways sharing the auth realm of url
+	Gateways           []string `toml:"gateways"`
+	GatewayPolicy      string   `toml:"gatewayPolicy"`
+	GatewayMaxFailures int      `toml:"gatewayMaxFailures"`
+	// name of the profile to connect to on startup
+	Profile string `toml:"profile"`
+}
+
+// values used for any key that is not present in config.toml
+func DefaultConfig() Config {
+	return Config{
+		Controller: ControllerConfig{
+			IntervalSeconds:               1,
+			HealthCheckGracePeriodSeconds: 5,
+		},
+		DsidWriter: DsidWriterConfig{
+			IntervalSeconds: 1,
+		},
+		DsidStore: DsidStoreConfig{
+			Backend: dsidStoreFile,
+		},
+		DsidTracker: DsidTrackerConfig{
+			TtlHours:   24,
+			MaxEntries: 64,
+		},
+		DsidValidation: DsidValidationConfig{
+			TimeoutSeconds: 10,
+			RetrySeconds:   60,
+			VerifyTLS:      true,
+		},
+		DsidCookiePoller: DsidCookiePollerConfig{
+			CookieName:      "DSID",
+			FallbackSeconds: 60,
+		},
+		HealthCheck: HealthCheckConfig{
+			Host:           "8.8.8.8",
+			Port:           "53",
+			TimeoutSeconds: 2,
+		},
+		OpenConnect: OpenConnectConfig{
+			Verbose:                    true,
+			ShutdownGracePeriodSeconds: 5,
+		},
+		Preflight: PreflightConfig{
+			TimeoutSeconds: 5,
+			RetrySeconds:   5,
+			VerifyTLS:      true,
+		},
+		NetworkEvents: NetworkEventsConfig{
+			DebounceMilliseconds: 1500,
+			IgnoreInterfaces:     []string{"tun*", "lo"},
+		},
+		NetworkRestore: NetworkRestoreConfig{
+			StateFile:           "/run/vpn-manager.network.json",
+			FallbackNameservers: []string{"1.1.1.1", "8.8.8.8"},
+		},
+		Unprivileged: UnprivilegedConfig{
+			Interface:    "tun-vpn",
+			HelperSocket: "/run/vpn-manager-helper.sock",
+		},
+		Namespace: NamespaceConfig{
+			Name: "vpn",
+		},
+		KillSwitch: KillSwitchConfig{
+			AllowDns: true,
+		},
+		TunnelStats: TunnelStatsConfig{
+			StallSeconds: 30,
+		},
+		Proxy: ProxyConfig{
+			Program:   "ocproxy",
+			SocksPort: 1080,
+		},
+		Vpn: VPNConfig{
+			Protocol:           "pulse",
+			GatewayPolicy:      GatewayFailover,
+			GatewayMaxFailures: 2,
+		},
+	}
+}
+
+// a problem with a single key. Line is 0 when the key does not appear in the file
+type ConfigError struct {
+	Key     string
+	Line    int
+	Message string
+}
+
+type ConfigErrors struct {
+	Path   string
+	Errors []ConfigError
+}
+
+func (e *ConfigErrors) Error() string {
+	var buf strings.Builder
+	for i, ce := range e.Errors {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		if ce.Line > 0 {
+			fmt.Fprintf(&buf, "%s:%d: %s: %s", e.Path, ce.Line, ce.Key, ce.Message)
+		} else {
+			fmt.Fprintf(&buf, "%s: %s: %s", e.Path, ce.Key, ce.Message)
+		}
+	}
+	return buf.String()
+}
+
+// load the effective configuration: defaults, the TOML file, OCMON_* environment
+// variables and section.key=value overrides
+func LoadConfig(configPath string, overrides []string) (Config, error) {
+	config, _, err := NewConfigLoader(configPath, overrides).Load()
+	if err != nil {
+		return Config{}, err
+	}
+	fmt.Fprintf(os.Stderr, "loaded config file from %s\n", configPath)
+	return config, nil
+}
+
+// defaults that depend on other settings
+func (c *Config) applyDerivedDefaults() {
+	if c.DsidCookiePoller.CookieHost == "" {
+		if u, err := url.Parse(c.Vpn.Url); err == nil {
+			c.DsidCookiePoller.CookieHost = u.Hostname()
+		}
+	}
+}
+
+func (c Config) Validate() []ConfigError {
+	var problems []ConfigError
+	add := func(key string, format string, args ...any) {
+		problems = append(problems, ConfigError{Key: key, Message: fmt.Sprintf(format, args...)})
+	}
+	positive := func(key string, value int) {
+		if value <= 0 {
+			add(key, "must be greater than 0, got %d", value)
+		}
+	}
+
+	positive("controller.intervalSeconds", c.Controller.IntervalSeconds)
+	if c.Controller.HealthCheckGracePeriodSeconds < 0 {
+		add("controller.healthCheckGracePeriodSeconds", "must not be negative, got %d", c.Controller.HealthCheckGracePeriodSeconds)
+	}
+	positive("dsidWriter.intervalSeconds", c.DsidWriter.IntervalSeconds)
+	if !slices.Contains(dsidStoreBackends, c.DsidStore.Backend) {
+		add("dsidStore.backend", "must be one of %s, got %q", strings.Join(dsidStoreBackends, ", "), c.DsidStore.Backend)
+	}
+	if c.DsidTracker.TtlHours < 0 {
+		add("dsidTracker.ttlHours", "must not be negative, got %d", c.DsidTracker.TtlHours)
+	}
+	positive("dsidTracker.maxEntries", c.DsidTracker.MaxEntries)
+	positive("dsidValidation.timeoutSeconds", c.DsidValidation.TimeoutSeconds)
+	positive("dsidValidation.retrySeconds", c.DsidValidation.RetrySeconds)
+
+	positive("dsidCookiePoller.fallbackSeconds", c.DsidCookiePoller.FallbackSeconds)
+	if c.DsidCookiePoller.CookieName == "" {
+		add("dsidCookiePoller.cookieName", "is required")
+	}
+	if c.DsidCookiePoller.CookiePath != "" {
+		if _, err := os.Stat(c.DsidCookiePoller.CookiePath); err != nil {
+			add("dsidCookiePoller.cookiePath", "%v", err)
+		}
+		if c.DsidCookiePoller.BrowserProfile != "" || c.DsidCookiePoller.AllProfiles {
+			add("dsidCookiePoller.cookiePath", "cannot be combined with browserProfile or allProfiles")
+		}
+	}
+	if c.DsidCookiePoller.Browser != "" && !slices.Contains(chromiumBrowserNames(), c.DsidCookiePoller.Browser) {
+		add("dsidCookiePoller.browser", "must be one of %s, got %q", strings.Join(chromiumBrowserNames(), ", "), c.DsidCookiePoller.Browser)
+	}
+	if c.DsidCookiePoller.BrowserProfile != "" && c.DsidCookiePoller.AllProfiles {
+		add("dsidCookiePoller.allProfiles", "cannot be combined with browserProfile")
+	}
+
+	if c.HealthCheck.Host == "" {
+		add("healthCheck.host", "is required")
+	}
+	if port, err := strconv.Atoi(c.HealthCheck.Port); err != nil || port < 1 || port > 65535 {
+		add("healthCheck.port", "must be a port number between 1 and 65535, got %q", c.HealthCheck.Port)
+	}
+	positive("healthCheck.timeoutSeconds", c.HealthCheck.TimeoutSeconds)
+
+	positive("openconnect.shutdownGracePeriodSeconds", c.OpenConnect.ShutdownGracePeriodSeconds)
+
+	positive("preflight.timeoutSeconds", c.Preflight.TimeoutSeconds)
+	positive("preflight.retrySeconds", c.Preflight.RetrySeconds)
+	positive("networkEvents.debounceMilliseconds", c.NetworkEvents.DebounceMilliseconds)
+	for _, pattern := range c.NetworkEvents.IgnoreInterfaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			add("networkEvents.ignoreInterfaces", "invalid pattern %q: %v", pattern, err)
+		}
+	}
+	if c.NetworkRestore.StateFile == "" {
+		add("networkRestore.stateFile", "is required")
+	}
+	for _, nameserver := range c.NetworkRestore.FallbackNameservers {
+		if net.ParseIP(nameserver) == nil {
+			add("networkRestore.fallbackNameservers", "must be IP addresses, got %q", nameserver)
+		}
+	}
+	for key, cidrs := range map[string][]string{"vpncScript.includeRoutes": c.VpncScript.IncludeRoutes, "vpncScript.excludeRoutes": c.VpncScript.ExcludeRoutes} {
+		for _, cidr := range cidrs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				add(key, "must be subnets in CIDR notation, got %q", cidr)
+			}
+		}
+	}
+	for _, domain := range c.VpncScript.DnsDomains {
+		if strings.TrimSpace(domain) == "" || strings.ContainsAny(domain, " ~") {
+			add("vpncScript.dnsDomains", "must be plain domain names, got %q", domain)
+		}
+	}
+	if c.Unprivileged.Enabled && c.Unprivileged.User == "" {
+		add("unprivileged.user", "is required when unprivileged.enabled is set")
+	}
+	if name := c.Unprivileged.Interface; name == "" || len(name) > 15 || strings.ContainsAny(name, "/ ") {
+		add("unprivileged.interface", "must be an interface name of at most 15 characters, got %q", name)
+	}
+	if c.Unprivileged.HelperSocket == "" {
+		add("unprivileged.helperSocket", "is required")
+	}
+	if name := c.Namespace.Name; name == "" || strings.ContainsAny(name, "/ ") || name == "." || name == ".." {
+		add("namespace.name", "must be a plain name, got %q", name)
+	}
+	if c.Namespace.Enabled && c.Unprivileged.Enabled {
+		add("namespace.enabled", "cannot be combined with unprivileged.enabled")
+	}
+	if c.Proxy.Program == "" {
+		add("proxy.program", "is required")
+	}
+	if c.Proxy.SocksPort < 1 || c.Proxy.SocksPort > 65535 {
+		add("proxy.socksPort", "must be a port number, got %d", c.Proxy.SocksPort)
+	}
+	if c.Proxy.HttpPort < 0 || c.Proxy.HttpPort > 65535 {
+		add("proxy.httpPort", "must be a port number or 0, got %d", c.Proxy.HttpPort)
+	}
+	if c.Proxy.HttpPort != 0 && path.Base(c.Proxy.Program) == "ocproxy" {
+		add("proxy.httpPort", "needs tunsocks, ocproxy only has a SOCKS proxy")
+	}
+	if c.Proxy.Enabled && (c.VpncScript.Enabled || c.Unprivileged.Enabled || c.Namespace.Enabled) {
+		add("proxy.enabled", "cannot be combined with vpncScript, unprivileged or namespace, there is no tun device")
+	}
+	for _, cidr := range c.KillSwitch.AllowSubnets {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			add("killSwitch.allowSubnets", "must be subnets in CIDR notation, got %q", cidr)
+		}
+	}
+	positive("tunnelStats.stallSeconds", c.TunnelStats.StallSeconds)
+	if c.KillSwitch.Enabled && c.Namespace.Enabled {
+		add("killSwitch.enabled", "has no effect with namespace.enabled, the host never uses the tunnel")
+	}
+	if c.Preflight.CaptivePortalUrl != "" {
+		if u, err := url.Parse(c.Preflight.CaptivePortalUrl); err != nil || u.Host == "" {
+			add("preflight.captivePortalUrl", "must be a URL with a host, got %q", c.Preflight.CaptivePortalUrl)
+		}
+	}
+
+	return append(problems, c.validateProfiles()...)
+}
+
+// render the effective configuration, defaults included, as TOML
+func (c Config) String() string {
+	out, err := toml.Marshal(c)
+	if err != nil {
+		return fmt.Sprintf("# error encoding config: %v\n", err)
+	}
+	return string(out)
+}
+
+func describeDecodeError(name string, err error) error {
+	var strictErr *toml.StrictMissingError
+	if errors.As(err, &strictErr) {
+		var buf strings.Builder
+		for i, e := range strictErr.Errors {
+			if i > 0 {
+				buf.WriteString("\n")
+			}
+			row, col := e.Position()
+			fmt.Fprintf(&buf, "%s:%d:%d: unknown key %s", name, row, col, strings.Join(e.Key(), "."))
+		}
+		return errors.New(buf.String())
+	}
+	var decodeErr *toml.DecodeError
+	if errors.As(err, &decodeErr) {
+		row, col := decodeErr.Position()
+		return fmt.Errorf("%s:%d:%d: %s\n%s", name, row, col, strings.TrimPrefix(decodeErr.Error(), "toml: "), decodeErr.String())
+	}
+	return fmt.Errorf("%s: %w", name, err)
 }
 
-func LoadConfig(configPath string) (Config, error) {
-	config := Config{}
-	tomlBytes, err := os.ReadFile(configPath)
-	if err == nil {
-		err = toml.Unmarshal(tomlBytes, &config)
-		if err == nil {
-			fmt.Printf("loaded config file from %s\n", configPath)
-			return config, nil
+// map of lower cased "section.key" to the line it is defined on, used to point
+// validation errors at the offending line
+func keyLines(tomlBytes []byte) map[string]int {
+	lines := make(map[string]int)
+	section := ""
+	sc := bufio.NewScanner(bytes.NewReader(tomlBytes))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "["):
+			section = strings.Trim(line, "[] \t")
+			lines[strings.ToLower(section)] = n
+		default:
+			key, _, found := strings.Cut(line, "=")
+			if !found {
+				continue
+			}
+			key = strings.Trim(strings.TrimSpace(key), `"'`)
+			if section != "" {
+				key = section + "." + key
+			}
+			lines[strings.ToLower(key)] = n
 		}
 	}
-	return Config{}, err
+	return lines
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+/*
+ConfigLoader:
+Builds the effective configuration from layers, each overriding the one before:
+defaults, the TOML file, OCMON_<SECTION>_<KEY> environment variables and finally
+`-set section.key=value` flags. The source of every value is kept so that
+check-config can explain where a setting came from.
+*/
+
+const envPrefix = "OCMON_"
+
+type ConfigLoader struct {
+	path      string
+	env       []string
+	overrides []string
+}
+
+// source of each effective value keyed by "section.key"
+type ConfigSources map[string]string
+
+func NewConfigLoader(path string, overrides []string) *ConfigLoader {
+	return &ConfigLoader{path: path, env: os.Environ(), overrides: overrides}
+}
+
+func (l *ConfigLoader) Load() (Config, ConfigSources, error) {
+	tomlBytes, err := os.ReadFile(l.path)
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	config := DefaultConfig()
+	decoder := toml.NewDecoder(bytes.NewReader(tomlBytes)).DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return Config{}, nil, describeDecodeError(l.path, err)
+	}
+
+	settings := configSettings(&config)
+	sources := make(ConfigSources)
+	fileLines := keyLines(tomlBytes)
+	for key := range settings {
+		if _, ok := fileLines[strings.ToLower(key)]; ok {
+			sources[key] = "file"
+		} else {
+			sources[key] = "default"
+		}
+	}
+
+	if err := applyEnvOverrides(settings, sources, l.env); err != nil {
+		return Config{}, nil, err
+	}
+	if err := applySetOverrides(settings, sources, l.overrides); err != nil {
+		return Config{}, nil, err
+	}
+
+	cookieHost := config.DsidCookiePoller.CookieHost
+	config.applyDerivedDefaults()
+	if config.DsidCookiePoller.CookieHost != cookieHost {
+		sources["dsidCookiePoller.cookieHost"] = "derived from vpn.url"
+	}
+
+	if problems := config.Validate(); len(problems) > 0 {
+		for i := range problems {
+			// only point at a line when the bad value actually came from the file
+			if sources[problems[i].Key] == "file" {
+				problems[i].Line = fileLines[strings.ToLower(problems[i].Key)]
+			} else if source := sources[problems[i].Key]; source != "" && source != "default" {
+				problems[i].Message += " (from " + source + ")"
+			}
+		}
+		return Config{}, nil, &ConfigErrors{Path: l.path, Errors: problems}
+	}
+	return config, sources, nil
+}
+
+// addressable values of every scalar setting in config, keyed by "section.key"
+func configSettings(config *Config) map[string]reflect.Value {
+	settings := make(map[string]reflect.Value)
+	root := reflect.ValueOf(config).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		section := root.Field(i)
+		if section.Kind() != reflect.Struct {
+			continue
+		}
+		sectionName := tomlName(root.Type().Field(i))
+		for j := 0; j < section.NumField(); j++ {
+			field := section.Field(j)
+			switch field.Kind() {
+			case reflect.String, reflect.Int, reflect.Bool:
+				settings[sectionName+"."+tomlName(section.Type().Field(j))] = field
+			case reflect.Slice:
+				if field.Type().Elem().Kind() == reflect.String {
+					settings[sectionName+"."+tomlName(section.Type().Field(j))] = field
+				}
+			}
+		}
+	}
+	return settings
+}
+
+func tomlName(field reflect.StructField) string {
+	if name, _, _ := strings.Cut(field.Tag.Get("toml"), ","); name != "" {
+		return name
+	}
+	return field.Name
+}
+
+// environment variable that overrides key, e.g. OCMON_HEALTHCHECK_HOST for healthCheck.host
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+func applyEnvOverrides(settings map[string]reflect.Value, sources ConfigSources, env []string) error {
+	byEnv := make(map[string]string)
+	for key := range settings {
+		byEnv[envName(key)] = key
+	}
+	var errs []error
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		key, ok := byEnv[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown config key", name))
+			continue
+		}
+		if err := setValue(settings[key], value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		sources[key] = "env " + name
+	}
+	return errors.Join(errs...)
+}
+
+func applySetOverrides(settings map[string]reflect.Value, sources ConfigSources, overrides []string) error {
+	byLowerKey := make(map[string]string)
+	for key := range settings {
+		byLowerKey[strings.ToLower(key)] = key
+	}
+	var errs []error
+	for _, override := range overrides {
+		name, value, found := strings.Cut(override, "=")
+		if !found {
+			errs = append(errs, fmt.Errorf("-set %s: expected section.key=value", override))
+			continue
+		}
+		key, ok := byLowerKey[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			errs = append(errs, fmt.Errorf("-set %s: unknown config key", name))
+			continue
+		}
+		if err := setValue(settings[key], value); err != nil {
+			errs = append(errs, fmt.Errorf("-set %s: %w", name, err))
+			continue
+		}
+		sources[key] = "flag -set"
+	}
+	return errors.Join(errs...)
+}
+
+func setValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		// lists are given comma separated
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("cannot override a %s", v.Kind())
+	}
+	return nil
+}
+
+// the effective configuration as TOML with the source of each value as a comment
+func (c Config) Annotated(sources ConfigSources) string {
+	var buf strings.Builder
+	section := ""
+	for _, line := range strings.Split(strings.TrimRight(c.String(), "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "["):
+			section = strings.Trim(trimmed, "[]")
+		case strings.Contains(trimmed, " = "):
+			key, _, _ := strings.Cut(trimmed, " = ")
+			if source, ok := sources[section+"."+key]; ok {
+				line = fmt.Sprintf("%-50s # %s", line, source)
+			}
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// repeatable string flag
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
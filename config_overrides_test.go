@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	for key, want := range map[string]string{
+		"healthCheck.host":            "OCMON_HEALTHCHECK_HOST",
+		"dsidCookiePoller.cookieName": "OCMON_DSIDCOOKIEPOLLER_COOKIENAME",
+	} {
+		if got := envName(key); got != want {
+			t.Errorf("envName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigLoader(t *testing.T) {
+	file := "[vpn]\nurl = \"https://vpn.example.com/corp\"\n\n[healthCheck]\nhost = \"10.0.0.1\"\nport = \"443\"\n"
+	tests := []struct {
+		name      string
+		env       []string
+		overrides []string
+		check     func(t *testing.T, config Config, sources ConfigSources)
+		wantErr   []string
+	}{
+		{
+			name: "file and defaults",
+			check: func(t *testing.T, config Config, sources ConfigSources) {
+				if config.HealthCheck.Host != "10.0.0.1" || sources["healthCheck.host"] != "file" {
+					t.Errorf("healthCheck.host = %q from %q", config.HealthCheck.Host, sources["healthCheck.host"])
+				}
+				if sources["controller.intervalSeconds"] != "default" {
+					t.Errorf("controller.intervalSeconds from %q", sources["controller.intervalSeconds"])
+				}
+				if config.DsidCookiePoller.CookieHost != "vpn.example.com" || sources["dsidCookiePoller.cookieHost"] != "derived from vpn.url" {
+					t.Errorf("dsidCookiePoller.cookieHost = %q from %q", config.DsidCookiePoller.CookieHost, sources["dsidCookiePoller.cookieHost"])
+				}
+			},
+		},
+		{
+			name: "env overrides file",
+			env:  []string{"PATH=/usr/bin", "OCMON_HEALTHCHECK_HOST=10.0.0.2", "OCMON_CONTROLLER_INTERVALSECONDS=5", "OCMON_VPNCSCRIPT_DNSDOMAINS=a.example.com, b.example.com,"},
+			check: func(t *testing.T, config Config, sources ConfigSources) {
+				if config.HealthCheck.Host != "10.0.0.2" || sources["healthCheck.host"] != "env OCMON_HEALTHCHECK_HOST" {
+					t.Errorf("healthCheck.host = %q from %q", config.HealthCheck.Host, sources["healthCheck.host"])
+				}
+				if config.Controller.IntervalSeconds != 5 {
+					t.Errorf("controller.intervalSeconds = %d", config.Controller.IntervalSeconds)
+				}
+				if !slices.Equal(config.VpncScript.DnsDomains, []string{"a.example.com", "b.example.com"}) {
+					t.Errorf("vpncScript.dnsDomains = %q", config.VpncScript.DnsDomains)
+				}
+			},
+		},
+		{
+			name:      "set overrides env",
+			env:       []string{"OCMON_HEALTHCHECK_HOST=10.0.0.2"},
+			overrides: []string{"healthcheck.HOST=10.0.0.3", " killSwitch.enabled =true"},
+			check: func(t *testing.T, config Config, sources ConfigSources) {
+				if config.HealthCheck.Host != "10.0.0.3" || sources["healthCheck.host"] != "flag -set" {
+					t.Errorf("healthCheck.host = %q from %q", config.HealthCheck.Host, sources["healthCheck.host"])
+				}
+				if !config.KillSwitch.Enabled {
+					t.Error("killSwitch.enabled not set")
+				}
+			},
+		},
+		{
+			name:    "unknown env key",
+			env:     []string{"OCMON_HEALTHCHECK_HOTS=10.0.0.2"},
+			wantErr: []string{"OCMON_HEALTHCHECK_HOTS: unknown config key"},
+		},
+		{
+			name:    "bad env values",
+			env:     []string{"OCMON_CONTROLLER_INTERVALSECONDS=ten", "OCMON_KILLSWITCH_ENABLED=maybe"},
+			wantErr: []string{`OCMON_CONTROLLER_INTERVALSECONDS: invalid integer "ten"`, `OCMON_KILLSWITCH_ENABLED: invalid boolean "maybe"`},
+		},
+		{
+			name:      "bad set flags",
+			overrides: []string{"healthCheck.host", "healthCheck.hots=1", "healthCheck.timeoutSeconds=soon"},
+			wantErr:   []string{"-set healthCheck.host: expected section.key=value", "-set healthCheck.hots: unknown config key", `-set healthCheck.timeoutSeconds: invalid integer "soon"`},
+		},
+		{
+			name:      "invalid override names its source",
+			overrides: []string{"healthCheck.port=0"},
+			wantErr:   []string{"healthCheck.port", "(from flag -set)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loader := NewConfigLoader(writeConfigFile(t, file), tt.overrides)
+			loader.env = tt.env
+			config, sources, err := loader.Load()
+			if len(tt.wantErr) > 0 {
+				if err == nil {
+					t.Fatal("Load() succeeded")
+				}
+				for _, want := range tt.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("Load() error %q lacks %q", err, want)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() = %v", err)
+			}
+			tt.check(t, config, sources)
+		})
+	}
+}
+
+// validation errors of values from the file point at their line
+func TestConfigLoaderLines(t *testing.T) {
+	loader := NewConfigLoader(writeConfigFile(t, "[vpn]\nurl = \"https://vpn.example.com\"\n\n[healthCheck]\nport = \"0\"\n"), nil)
+	loader.env = nil
+	_, _, err := loader.Load()
+	var configErrs *ConfigErrors
+	if !errors.As(err, &configErrs) {
+		t.Fatalf("Load() = %v, want ConfigErrors", err)
+	}
+	if len(configErrs.Errors) != 1 || configErrs.Errors[0].Key != "healthCheck.port" || configErrs.Errors[0].Line != 5 {
+		t.Errorf("Load() errors = %+v, want healthCheck.port on line 5", configErrs.Errors)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+// the defaults with the one setting that has none
+func validConfig() Config {
+	config := DefaultConfig()
+	config.Vpn.Url = "https://vpn.example.com/corp"
+	config.applyDerivedDefaults()
+	return config
+}
+
+func problemKeys(problems []ConfigError) []string {
+	var keys []string
+	for _, problem := range problems {
+		keys = append(keys, problem.Key)
+	}
+	return keys
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   []string
+	}{
+		{"defaults", func(c *Config) {}, nil},
+		{"zero interval", func(c *Config) { c.Controller.IntervalSeconds = 0 }, []string{"controller.intervalSeconds"}},
+		{"negative grace period", func(c *Config) { c.Controller.HealthCheckGracePeriodSeconds = -1 }, []string{"controller.healthCheckGracePeriodSeconds"}},
+		{"unknown store backend", func(c *Config) { c.DsidStore.Backend = "etcd" }, []string{"dsidStore.backend"}},
+		{"negative ttl", func(c *Config) { c.DsidTracker.TtlHours = -1 }, []string{"dsidTracker.ttlHours"}},
+		{"no cookie name", func(c *Config) { c.DsidCookiePoller.CookieName = "" }, []string{"dsidCookiePoller.cookieName"}},
+		{"missing cookie file", func(c *Config) { c.DsidCookiePoller.CookiePath = t.TempDir() + "/Cookies" }, []string{"dsidCookiePoller.cookiePath"}},
+		{"cookie file and profile", func(c *Config) {
+			c.DsidCookiePoller.CookiePath = t.TempDir()
+			c.DsidCookiePoller.BrowserProfile = "Default"
+		}, []string{"dsidCookiePoller.cookiePath"}},
+		{"profile and all profiles", func(c *Config) {
+			c.DsidCookiePoller.BrowserProfile = "Default"
+			c.DsidCookiePoller.AllProfiles = true
+		}, []string{"dsidCookiePoller.allProfiles"}},
+		{"unknown browser", func(c *Config) { c.DsidCookiePoller.Browser = "netscape" }, []string{"dsidCookiePoller.browser"}},
+		{"no health check host", func(c *Config) { c.HealthCheck.Host = "" }, []string{"healthCheck.host"}},
+		{"port not a number", func(c *Config) { c.HealthCheck.Port = "http" }, []string{"healthCheck.port"}},
+		{"port out of range", func(c *Config) { c.HealthCheck.Port = "65536" }, []string{"healthCheck.port"}},
+		{"bad interface pattern", func(c *Config) { c.NetworkEvents.IgnoreInterfaces = []string{"veth["} }, []string{"networkEvents.ignoreInterfaces"}},
+		{"bad nameserver", func(c *Config) { c.NetworkRestore.FallbackNameservers = []string{"dns.example.com"} }, []string{"networkRestore.fallbackNameservers"}},
+		{"bad routes", func(c *Config) {
+			c.VpncScript.IncludeRoutes = []string{"10.0.0.0"}
+			c.VpncScript.ExcludeRoutes = []string{"10.1.0.0/33"}
+		}, []string{"vpncScript.excludeRoutes", "vpncScript.includeRoutes"}},
+		{"routing domain", func(c *Config) { c.VpncScript.DnsDomains = []string{"~corp.example.com"} }, []string{"vpncScript.dnsDomains"}},
+		{"unprivileged without user", func(c *Config) {
+			c.Unprivileged.Enabled = true
+			c.Unprivileged.User = ""
+		}, []string{"unprivileged.user"}},
+		{"long interface name", func(c *Config) { c.Unprivileged.Interface = "a-very-long-tun-name" }, []string{"unprivileged.interface"}},
+		{"namespace path", func(c *Config) { c.Namespace.Name = "../vpn" }, []string{"namespace.name"}},
+		{"namespace and unprivileged", func(c *Config) {
+			c.Namespace.Enabled = true
+			c.Unprivileged.Enabled = true
+			c.Unprivileged.User = "vpn"
+		}, []string{"namespace.enabled"}},
+		{"http proxy with ocproxy", func(c *Config) {
+			c.Proxy.Program = "/usr/bin/ocproxy"
+			c.Proxy.HttpPort = 8080
+		}, []string{"proxy.httpPort"}},
+		{"proxy and vpnc script", func(c *Config) {
+			c.Proxy.Enabled = true
+			c.VpncScript.Enabled = true
+		}, []string{"proxy.enabled"}},
+		{"kill switch in namespace", func(c *Config) {
+			c.KillSwitch.Enabled = true
+			c.Namespace.Enabled = true
+		}, []string{"killSwitch.enabled"}},
+		{"bad kill switch subnet", func(c *Config) { c.KillSwitch.AllowSubnets = []string{"lan"} }, []string{"killSwitch.allowSubnets"}},
+		{"captive portal url without host", func(c *Config) { c.Preflight.CaptivePortalUrl = "generate_204" }, []string{"preflight.captivePortalUrl"}},
+		{"no vpn url", func(c *Config) { c.Vpn.Url = "" }, []string{"vpn.url"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := validConfig()
+			tt.modify(&config)
+			got := problemKeys(config.Validate())
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Validate() problems at %v, want %v\n%v", got, tt.want, config.Validate())
+			}
+		})
+	}
+}
+
+func decodeConfig(content string) error {
+	config := DefaultConfig()
+	return toml.NewDecoder(strings.NewReader(content)).DisallowUnknownFields().Decode(&config)
+}
+
+func TestDescribeDecodeError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want []string
+	}{
+		{
+			name: "unknown keys",
+			err:  decodeConfig("[vpn]\nurl = \"https://vpn.example.com\"\nuser = \"me\"\n\n[healthCheck]\nhots = \"10.0.0.1\"\n"),
+			want: []string{"config.toml:3:1: unknown key vpn.user", "config.toml:6:1: unknown key healthCheck.hots"},
+		},
+		{
+			name: "wrong type",
+			err:  decodeConfig("[controller]\nintervalSeconds = \"ten\"\n"),
+			want: []string{"config.toml:2:"},
+		},
+		{
+			name: "syntax",
+			err:  decodeConfig("[vpn\nurl = 1\n"),
+			want: []string{"config.toml:1:"},
+		},
+		{
+			name: "other errors",
+			err:  errors.New("permission denied"),
+			want: []string{"config.toml: permission denied"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.err == nil {
+				t.Fatal("decoding did not fail")
+			}
+			got := describeDecodeError("config.toml", tt.err).Error()
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("describeDecodeError() = %q, want it to contain %q", got, want)
+				}
+			}
+			if strings.Contains(got, ": toml: ") {
+				t.Errorf("describeDecodeError() kept the library prefix: %q", got)
+			}
+		})
+	}
+}
+
+func TestKeyLines(t *testing.T) {
+	content := "# comment\n[vpn]\nurl = \"https://vpn.example.com\"\n\n[healthCheck]\n  \"host\" = \"10.0.0.1\"\nPort = \"443\"\n"
+	lines := keyLines([]byte(content))
+	for key, want := range map[string]int{"vpn": 2, "vpn.url": 3, "healthcheck": 5, "healthcheck.host": 6, "healthcheck.port": 7} {
+		if lines[key] != want {
+			t.Errorf("keyLines()[%q] = %d, want %d", key, lines[key], want)
+		}
+	}
+	if _, ok := lines["comment"]; ok {
+		t.Error("keyLines() picked up a comment")
+	}
+}
+
+// the shipped template loads as is
+func TestConfigTemplate(t *testing.T) {
+	loader := NewConfigLoader("config.toml.template", nil)
+	loader.env = nil
+	if _, _, err := loader.Load(); err != nil {
+		t.Fatalf("config.toml.template: %v", err)
+	}
+}
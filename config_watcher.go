@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+/*
+ConfigWatcher:
+Signals when config.toml may have changed, either because the file was written or
+replaced (editors and home-manager swap the file or symlink rather than writing in
+place, so we watch the directory) or because the process received SIGHUP. Bursts of
+events are collapsed into a single notification.
+*/
+
+const configDebounce = 500 * time.Millisecond
+
+type ConfigWatcher struct {
+	path    string
+	changes chan struct{}
+	events  chan struct{}
+	log     *log.Logger
+}
+
+func NewConfigWatcher(path string) *ConfigWatcher {
+	return &ConfigWatcher{
+		path:    path,
+		changes: make(chan struct{}, 1),
+		events:  make(chan struct{}, 16),
+		log:     log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile),
+	}
+}
+
+func (w *ConfigWatcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+func (w *ConfigWatcher) Start() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			w.log.Printf("received SIGHUP, reloading %s", w.path)
+			w.notify()
+		}
+	}()
+
+	if err := w.watchFile(); err != nil {
+		// SIGHUP still works, so this is not fatal
+		w.log.Printf("not watching %s for changes: %v", w.path, err)
+	}
+	go w.debounce()
+}
+
+func (w *ConfigWatcher) notify() {
+	select {
+	case w.events <- struct{}{}:
+	default:
+	}
+}
+
+func (w *ConfigWatcher) debounce() {
+	for range w.events {
+		timer := time.NewTimer(configDebounce)
+	quiet:
+		for {
+			select {
+			case <-w.events:
+				timer.Reset(configDebounce)
+			case <-timer.C:
+				break quiet
+			}
+		}
+		select {
+		case w.changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *ConfigWatcher) watchFile() error {
+	abs, err := filepath.Abs(w.path)
+	if err != nil {
+		return err
+	}
+	dir, name := filepath.Split(abs)
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE)
+	return watchDirectory(dir, mask, w.log, func(changed string) {
+		if changed == name {
+			w.notify()
+		}
+	})
+}
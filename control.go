@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+Control interface:
+The manager listens on a unix socket so that the client subcommands (status, reconnect,
+history, ...) can talk to the running process. Each connection carries exactly one
+JSON encoded request followed by one JSON encoded response. Only the manager's own user
+can connect, unless SetOwner lets a group in.
+*/
+
+const defaultControlSocket = "/run/vpn-manager.sock"
+
+const controlTimeout = 10 * time.Second
+
+type ControlRequest struct {
+	Command string            `json:"command"`
+	Args    map[string]string `json:"args,omitempty"`
+}
+
+type ControlResponse struct {
+	Ok    bool            `json:"ok"`
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+type ControlHandler func(args map[string]string) (any, error)
+
+type ControlServer struct {
+	path string
+	// applied to the socket before it appears at path, see SetOwner
+	uid      int
+	gid      int
+	mode     os.FileMode
+	mu       sync.Mutex
+	handlers map[string]ControlHandler
+	listener net.Listener
+	log      *log.Logger
+}
+
+func NewControlServer(path string) *ControlServer {
+	return &ControlServer{
+		path:     path,
+		uid:      -1,
+		gid:      -1,
+		mode:     0600,
+		handlers: make(map[string]ControlHandler),
+		log:      log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile),
+	}
+}
+
+func (s *ControlServer) Handle(command string, handler ControlHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[command] = handler
+}
+
+func (s *ControlServer) Start() error {
+	// a socket left behind by a previous run is only removed if nobody answers on it
+	if _, err := os.Stat(s.path); err == nil {
+		if conn, err := net.DialTimeout("unix", s.path, time.Second); err == nil {
+			conn.Close()
+			return fmt.Errorf("control socket %s is in use by another manager", s.path)
+		}
+		if err := os.Remove(s.path); err != nil {
+			return fmt.Errorf("removing stale control socket: %w", err)
+		}
+	}
+	// bound under a temporary name and moved into place once its owner and mode are set,
+	// so that nobody else can connect in between
+	tmp := filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp")
+	_ = os.Remove(tmp)
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return fmt.Errorf("listen on control socket: %w", err)
+	}
+	// removed under its final name in Close
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	err = os.Chown(tmp, s.uid, s.gid)
+	if err == nil {
+		err = os.Chmod(tmp, s.mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		listener.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("setting up control socket: %w", err)
+	}
+	s.listener = listener
+	s.log.Printf("control socket listening on %s", s.path)
+	go s.acceptLoop()
+	return nil
+}
+
+// hand the socket to uid and gid with mode, before Start. -1 keeps the manager's own
+// user or group
+func (s *ControlServer) SetOwner(uid int, gid int, mode os.FileMode) {
+	s.uid, s.gid, s.mode = uid, gid, mode
+}
+
+func (s *ControlServer) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	os.Remove(s.path)
+	return err
+}
+
+func (s *ControlServer) acceptLoop() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.log.Printf("control socket accept error: %v", err)
+			}
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *ControlServer) serve(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var req ControlRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		s.respond(conn, nil, fmt.Errorf("malformed request: %w", err))
+		return
+	}
+
+	s.mu.Lock()
+	handler, ok := s.handlers[req.Command]
+	s.mu.Unlock()
+	if !ok {
+		s.respond(conn, nil, fmt.Errorf("unknown command %q", req.Command))
+		return
+	}
+	result, err := handler(req.Args)
+	s.respond(conn, result, err)
+}
+
+func (s *ControlServer) respond(conn net.Conn, result any, err error) {
+	resp := ControlResponse{Ok: err == nil}
+	if err != nil {
+		resp.Error = err.Error()
+	} else if result != nil {
+		data, merr := json.Marshal(result)
+		if merr != nil {
+			resp = ControlResponse{Error: fmt.Sprintf("encoding response: %v", merr)}
+		} else {
+			resp.Data = data
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		s.log.Printf("control socket write error: %v", err)
+	}
+}
+
+// send a single command to the running manager and decode its reply into out
+func controlCall(socketPath string, command string, args map[string]string, out any) error {
+	conn, err := net.DialTimeout("unix", socketPath, controlTimeout)
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s (is it running?): %w", socketPath, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err := json.NewEncoder(conn).Encode(ControlRequest{Command: command, Args: args}); err != nil {
+		return fmt.Errorf("sending %s request: %w", command, err)
+	}
+	var resp ControlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("reading %s response: %w", command, err)
+	}
+	if !resp.Ok {
+		return errors.New(resp.Error)
+	}
+	if out != nil && len(resp.Data) > 0 {
+		return json.Unmarshal(resp.Data, out)
+	}
+	return nil
+}
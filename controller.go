@@ -1,35 +1,219 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Controller struct {
 	interval               time.Duration
 	healthCheckGracePeriod time.Duration
-	dsidFileReader         *DSIDFileReader
 	healthChecker          *HealthChecker
 	openConnectProcess     *OpenConnectProcess
-	dsidTracker            *DSIDTracker
-	log                    *log.Logger
+
+	// profiles and their DSIDs. dsidStore and dsidTracker belong to the active profile
+	dsidPath      string
+	openDSIDStore func(profile string) DSIDStore
+	dsidTracking  DsidTrackerConfig
+	profiles      map[string]*profileState
+	profile       Profile
+	dsidStore     DSIDStore
+	dsidTracker   *DSIDTracker
+	gateways      *GatewaySelector
+
+	events   *EventLog
+	commands chan func()
+	ticker   *time.Ticker
+	log      *log.Logger
+
+	// hot reload of config.toml, see EnableReload
+	configLoader *ConfigLoader
+	config       Config
+	reloads      <-chan struct{}
+
+	// pre-connect reachability check, nil when disabled
+	preflight      *PreflightChecker
+	preflightRetry time.Duration
+
+	// last DSID feedback written for the poller, see feedback
+	lastFeedback string
+
+	// gateway check of new DSIDs, nil when disabled. pendingDSID is being checked, or
+	// got no clear answer at lastValidation. Checks run in the background and report
+	// on validations
+	dsidValidator   *DSIDValidator
+	validationRetry time.Duration
+	pendingDSID     string
+	lastValidation  time.Time
+	validating      bool
+	validations     chan dsidValidation
+
+	// rtnetlink notifications, see EnableNetworkEvents
+	networkChanges <-chan string
+
+	// logind suspend/resume notifications, see EnableSleepEvents
+	sleepMonitor *SleepMonitor
+	sleepEvents  <-chan bool
+
+	// nftables rules blocking traffic outside the tunnel, nil when disabled
+	killSwitch *KillSwitch
+
+	// tun device counters as a passive health check, nil when disabled. tunnelPid is
+	// the openconnect process they were sampled for
+	tunnelMonitor *TunnelMonitor
+	tunnelPid     int
+
+	// most recent health checks, oldest first, for the dashboard
+	healthSamples []HealthSample
 
 	// state variables
 	lastHealthyConnectionTime time.Time
+	state                     ControllerState
+	sleeping                  bool
+	upstreamDown              bool
+	upstreamReason            string
+	lastPreflight             time.Time
 }
 
-func NewController(config ControllerConfig, dsidFileReader *DSIDFileReader, healthChecker *HealthChecker, openConnectProcess *OpenConnectProcess) *Controller {
-	return &Controller{
+// DSID state kept per profile so that switching back and forth doesn't discard valid cookies
+type profileState struct {
+	profile     Profile
+	dsidStore   DSIDStore
+	dsidTracker *DSIDTracker
+	gateways    *GatewaySelector
+}
+
+func NewController(config ControllerConfig, dsidTracking DsidTrackerConfig, dsidPath string, openDSIDStore func(profile string) DSIDStore, profiles []Profile, activeProfile string, healthChecker *HealthChecker, openConnectProcess *OpenConnectProcess) *Controller {
+	c := &Controller{
 		interval:                  time.Duration(config.IntervalSeconds) * time.Second,
 		healthCheckGracePeriod:    time.Duration(config.HealthCheckGracePeriodSeconds) * time.Second,
-		dsidFileReader:          	 dsidFileReader,
 		healthChecker:             healthChecker,
 		openConnectProcess:        openConnectProcess,
-		dsidTracker:               NewDSIDTracker(),
+		dsidPath:                  dsidPath,
+		openDSIDStore:             openDSIDStore,
+		dsidTracking:              dsidTracking,
+		profiles:                  make(map[string]*profileState),
+		events:                    NewEventLog(200),
+		commands:                  make(chan func()),
+		validations:               make(chan dsidValidation, 1),
 		lastHealthyConnectionTime: time.Now(),
+		state:                     StateWaitingForDSID,
 		log:                       log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile),
 	}
+	c.updateProfiles(profiles)
+	c.activate(c.profiles[activeProfile])
+	c.openConnectProcess.setProfile(c.processProfile())
+	return c
+}
+
+// add new profiles, refresh the settings of existing ones and drop removed ones
+func (c *Controller) updateProfiles(profiles []Profile) {
+	seen := make(map[string]bool)
+	for _, profile := range profiles {
+		seen[profile.Name] = true
+		if state, ok := c.profiles[profile.Name]; ok {
+			if !slices.Equal(state.profile.Gateways, profile.Gateways) || state.profile.GatewayPolicy != profile.GatewayPolicy || state.profile.GatewayMaxFailures != profile.GatewayMaxFailures {
+				state.gateways = NewGatewaySelector(profile.Gateways, profile.GatewayPolicy, profile.GatewayMaxFailures)
+			}
+			state.profile = profile
+			continue
+		}
+		c.profiles[profile.Name] = &profileState{
+			profile:     profile,
+			dsidStore:   c.openDSIDStore(profile.Name),
+			dsidTracker: NewDSIDTracker(c.dsidTracking, c.dsidStateFile(profile.Name)),
+			gateways:    NewGatewaySelector(profile.Gateways, profile.GatewayPolicy, profile.GatewayMaxFailures),
+		}
+	}
+	for name := range c.profiles {
+		if !seen[name] {
+			delete(c.profiles, name)
+		}
+	}
+}
+
+func (c *Controller) dsidStateFile(profile string) string {
+	if c.dsidTracking.StateFile == "" {
+		return ""
+	}
+	return profileDSIDPath(c.dsidTracking.StateFile, profile)
+}
+
+func (c *Controller) activate(state *profileState) {
+	c.profile = state.profile
+	c.dsidStore = state.dsidStore
+	c.dsidTracker = state.dsidTracker
+	c.gateways = state.gateways
+}
+
+// the active profile pointed at the currently selected gateway
+func (c *Controller) processProfile() Profile {
+	profile := c.profile
+	profile.Url = c.gateways.current()
+	return profile
+}
+
+// count a failed connection against the current gateway, moving on to another one
+// once the gateway policy says so
+func (c *Controller) gatewayFailed(reason string) {
+	failed := c.gateways.current()
+	moved, exhausted := c.gateways.failure()
+	if exhausted {
+		c.record("gateway", "all %d gateways of profile %s failed, starting over in %s", len(c.profile.Gateways), c.profile.Name, c.gateways.backoff().Round(time.Second))
+	}
+	if moved {
+		c.record("gateway", "gateway %s failed (%s), moving to %s", failed, reason, c.gateways.current())
+		c.openConnectProcess.setProfile(c.processProfile())
+		// the gateway's addresses may have changed since they were let through
+		c.applyKillSwitch()
+	}
+}
+
+// stop the tunnel and connect to another profile, using whatever DSID it last had
+func (c *Controller) switchProfile(name string) error {
+	state, ok := c.profiles[name]
+	if !ok {
+		return fmt.Errorf("no profile named %q", name)
+	}
+	if name == c.profile.Name {
+		return nil
+	}
+	c.record("profile", "switching profile %s -> %s", c.profile.Name, name)
+	c.openConnectProcess.Stop()
+	c.activate(state)
+	c.openConnectProcess.setProfile(c.processProfile())
+	c.openConnectProcess.dsid = c.dsidTracker.current
+	c.lastHealthyConnectionTime = time.Now()
+	c.applyKillSwitch()
+	return nil
+}
+
+// tell the poller what became of dsid, once per DSID and status
+func (c *Controller) feedback(dsid string, status DSIDFeedbackStatus, reason string) {
+	key := c.profile.Name + " " + dsidHash(dsid) + " " + string(status)
+	if dsid == "" || key == c.lastFeedback {
+		return
+	}
+	c.lastFeedback = key
+	if err := writeDSIDFeedback(profileDSIDPath(c.dsidPath, c.profile.Name), dsid, status, reason); err != nil {
+		c.log.Printf("could not write DSID feedback: %v", err)
+	}
+}
+
+// log a message and keep it in the event history served to the history subcommand
+func (c *Controller) record(kind string, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	_ = c.log.Output(2, msg)
+	c.events.add(kind, msg)
 }
 
 func (c *Controller) eventLoop() {
@@ -41,62 +225,524 @@ func (c *Controller) eventLoop() {
 	if rejected {
 		// cookie rejected, mark as such and shutdown openconnect
 		c.dsidTracker.reject(currentDSID)
+		c.feedback(currentDSID, DSIDRejected, "rejected by the server")
 		if c.openConnectProcess.running {
-			c.log.Printf("DSID rejected, killing openconnect process (dsid=%s)", currentDSID)
+			c.record("dsid", "DSID rejected, killing openconnect process (dsid=%s)", maskDSID(currentDSID))
 			c.openConnectProcess.Stop()
 		}
 	}
+	if expires := c.openConnectProcess.attemptState.sessionExpires; !expires.IsZero() && time.Now().After(expires) {
+		c.feedback(currentDSID, DSIDExpired, "session expired at "+expires.Format(time.DateTime))
+	}
+
+	// openconnect gave up on its own before the tunnel came up, blame the gateway
+	if exited, connected := c.openConnectProcess.takeUnexpectedExit(); exited && !connected && !rejected {
+		c.gatewayFailed("openconnect exited before connecting")
+	}
 
 	// check if the openconnect process itself has marked itself as unhealthy but is still running
 	if c.openConnectProcess.running && c.openConnectProcess.attemptState.needsRestart {
-		c.log.Printf("openconnect marked itself as unhealthy, stopping pid=%d", c.openConnectProcess.cmd.Process.Pid)
+		c.record("restart", "openconnect marked itself as unhealthy, stopping pid=%d", c.openConnectProcess.pid())
 		c.openConnectProcess.Stop()
 	}
 
 	if c.openConnectProcess.running {
-		alive := c.healthChecker.check()
+		c.openConnectProcess.inspectTunnel()
+		stalled := c.tunnelStalled()
+		alive := c.checkHealth() && !stalled
 		if alive {
 			c.lastHealthyConnectionTime = time.Now()
 		} else {
 			if time.Since(c.lastHealthyConnectionTime) > c.healthCheckGracePeriod {
 				// health checks are failing, kill openconnect
-				c.log.Printf("Health checks failing for %s, killing current openconnect process %d", c.healthCheckGracePeriod, c.openConnectProcess.cmd.Process.Pid)
+				c.record("health", "Health checks failing for %s, killing current openconnect process %d", c.healthCheckGracePeriod, c.openConnectProcess.pid())
 				c.openConnectProcess.Stop()
+				c.gatewayFailed("health checks failing")
 				// possibly trigger browser open here to geta new cookie
 			}
 		}
 	}
 
-	if dsid, err := c.dsidFileReader.ReadDSID(); err == nil {
-		// new dsid cookie available, notify the cookie tracker
-		status := c.dsidTracker.notify(dsid)
-		switch status {
-		case Accepted:
-			{
-				// dsid changed, kill openconnect
-				c.log.Printf("DSID changed: %s", dsid)
-				c.openConnectProcess.dsid = c.dsidTracker.current
-				c.openConnectProcess.Stop()
-			}
-		}
-	} else {
+	if dsid, err := c.dsidStore.ReadDSID(); err != nil {
 		c.log.Printf("Error getting DSID cookie: %v", err)
+	} else if c.dsidUsable(dsid) {
+		c.useDSID(dsid)
+	}
+
+	if !c.openConnectProcess.running && c.gateways.updateRanking() {
+		c.record("gateway", "gateways of profile %s ranked by latency, connecting to %s", c.profile.Name, c.gateways.current())
+		c.openConnectProcess.setProfile(c.processProfile())
 	}
 
-	if !c.openConnectProcess.running && c.dsidTracker.current == c.openConnectProcess.dsid {
+	if !c.openConnectProcess.running && c.dsidTracker.current == c.openConnectProcess.dsid && c.dsidTracker.current != "" && !c.sleeping && c.gateways.backoff() == 0 && c.upstreamReachable() {
 		c.log.Printf("Starting openconnect")
-		c.openConnectProcess.Start()
+		if err := c.openConnectProcess.Start(); err == nil {
+			c.record("start", "openconnect started (pid=%d)", c.openConnectProcess.pid())
+		}
+	}
+
+	c.updateState()
+}
+
+// new dsid cookie available, notify the cookie tracker
+func (c *Controller) useDSID(dsid string) {
+	status := c.dsidTracker.notify(dsid)
+	switch status {
+	case Accepted:
+		{
+			// dsid changed, kill openconnect
+			c.record("dsid", "DSID changed: %s", maskDSID(dsid))
+			c.openConnectProcess.dsid = c.dsidTracker.current
+			c.openConnectProcess.Stop()
+		}
+	}
+}
+
+// check the current gateway before starting openconnect. While it is unreachable the
+// controller stays parked and only re-checks every preflightRetry
+func (c *Controller) upstreamReachable() bool {
+	if c.preflight == nil {
+		return true
+	}
+	if c.upstreamDown && time.Since(c.lastPreflight) < c.preflightRetry {
+		return false
+	}
+	c.lastPreflight = time.Now()
+	gateway := c.gateways.current()
+	result := c.preflight.check(gateway)
+	if !result.Ok {
+		if !c.upstreamDown || result.String() != c.upstreamReason {
+			c.record("network", "gateway %s unreachable, waiting for upstream network (%s)", gateway, result)
+		}
+		c.upstreamDown = true
+		c.upstreamReason = result.String()
+		return false
+	}
+	if c.upstreamDown {
+		c.record("network", "gateway %s reachable again", gateway)
+	}
+	c.upstreamDown = false
+	c.upstreamReason = ""
+	return true
+}
+
+func (c *Controller) EnablePreflight(config PreflightConfig) {
+	if !config.Enabled {
+		c.preflight = nil
+		c.upstreamDown = false
+		c.upstreamReason = ""
+		return
+	}
+	c.preflight = NewPreflightChecker(config)
+	c.preflightRetry = time.Duration(config.RetrySeconds) * time.Second
+}
+
+func (c *Controller) EnableDSIDValidation(config DsidValidationConfig, cookieName string) {
+	if !config.Enabled {
+		c.dsidValidator = nil
+		return
+	}
+	c.dsidValidator = NewDSIDValidator(config, cookieName)
+	c.validationRetry = time.Duration(config.RetrySeconds) * time.Second
+}
+
+// outcome of a background gateway check of dsid
+type dsidValidation struct {
+	validator *DSIDValidator
+	profile   string
+	dsid      string
+	verdict   DSIDVerdict
+	err       error
+}
+
+// whether to hand dsid to the tracker right away. A connected tunnel is only given up
+// for a new DSID the gateway accepts, which is checked in the background and handled
+// by dsidValidated
+func (c *Controller) dsidUsable(dsid string) bool {
+	if c.dsidValidator == nil || c.state != StateConnected || !c.dsidTracker.candidate(dsid) || !c.dsidValidator.supports(c.profile.Protocol) {
+		return true
+	}
+	if c.validating || dsid == c.pendingDSID && time.Since(c.lastValidation) < c.validationRetry {
+		return false
+	}
+	c.pendingDSID = dsid
+	c.lastValidation = time.Now()
+	c.validating = true
+	validator, profile, gateway := c.dsidValidator, c.profile.Name, c.processProfile().Url
+	go func() {
+		verdict, err := validator.validate(gateway, dsid)
+		c.validations <- dsidValidation{validator: validator, profile: profile, dsid: dsid, verdict: verdict, err: err}
+	}()
+	return false
+}
+
+func (c *Controller) dsidValidated(v dsidValidation) {
+	c.validating = false
+	if v.validator != c.dsidValidator || v.profile != c.profile.Name || !c.dsidTracker.candidate(v.dsid) {
+		// validation was reconfigured, the profile switched or the DSID was handled
+		// meanwhile, the next tick starts over
+		c.pendingDSID = ""
+		return
+	}
+	switch v.verdict {
+	case DSIDValid:
+		c.pendingDSID = ""
+		c.useDSID(v.dsid)
+		// start openconnect with it without waiting for the next tick
+		c.eventLoop()
+	case DSIDInvalid:
+		c.pendingDSID = ""
+		c.record("dsid", "new DSID %s rejected by the gateway, keeping the current tunnel", maskDSID(v.dsid))
+		c.dsidTracker.reject(v.dsid)
+		c.feedback(v.dsid, DSIDRejected, "rejected by the gateway before use")
+	default:
+		c.record("dsid", "could not validate new DSID %s, keeping the current tunnel: %v", maskDSID(v.dsid), v.err)
 	}
 }
 
-func (c *Controller) Start() {
-	ticker := time.NewTicker(c.interval)
-	defer ticker.Stop()
+// react to network changes as soon as they happen instead of waiting for the health
+// check grace period to run out
+func (c *Controller) EnableNetworkEvents(changes <-chan string) {
+	c.networkChanges = changes
+}
+
+func (c *Controller) networkChanged(reason string) {
+	c.record("network", "network changed: %s", reason)
+	// a parked controller re-checks the gateway on the next loop
+	c.lastPreflight = time.Time{}
+	if c.openConnectProcess.running && !c.checkHealth() {
+		c.record("restart", "tunnel unhealthy after network change, restarting openconnect")
+		c.openConnectProcess.Stop()
+		c.lastHealthyConnectionTime = time.Now()
+	}
+	c.eventLoop()
+}
+
+// stop openconnect cleanly before suspend and reconnect with the same DSID on resume
+func (c *Controller) EnableSleepEvents(monitor *SleepMonitor) {
+	c.sleepMonitor = monitor
+	c.sleepEvents = monitor.Events()
+}
+
+func (c *Controller) sleepChanged(sleeping bool) {
+	if sleeping {
+		c.sleeping = true
+		if c.openConnectProcess.running {
+			c.record("sleep", "system is going to sleep, stopping openconnect")
+			c.openConnectProcess.Stop()
+		} else {
+			c.record("sleep", "system is going to sleep")
+		}
+		c.updateState()
+		c.sleepMonitor.release()
+		return
+	}
+	c.sleeping = false
+	c.record("sleep", "system resumed, reconnecting")
+	c.sleepMonitor.inhibit()
+	c.lastHealthyConnectionTime = time.Now()
+	c.lastPreflight = time.Time{}
+	c.eventLoop()
+}
+
+// block traffic outside the tunnel whenever it is not connected
+func (c *Controller) EnableKillSwitch(killSwitch *KillSwitch) {
+	c.killSwitch = killSwitch
+}
+
+// treat a tunnel that sends without receiving as unhealthy
+func (c *Controller) EnableTunnelStats(monitor *TunnelMonitor) {
+	c.tunnelMonitor = monitor
+}
+
+func (c *Controller) tunnelStalled() bool {
+	p := c.openConnectProcess
+	// no device in proxy mode, or not yet
+	if c.tunnelMonitor == nil || !p.running || p.attemptState.link == nil {
+		return false
+	}
+	if pid := p.pid(); pid != c.tunnelPid {
+		c.tunnelPid = pid
+		c.tunnelMonitor.reset()
+	}
+	iface := p.attemptState.link.Interface
+	wasStalled := c.tunnelMonitor.status != nil && c.tunnelMonitor.status.Stalled
+	stalled, err := c.tunnelMonitor.sample(iface)
+	if err != nil {
+		return false
+	}
+	if stalled && !wasStalled {
+		status := c.tunnelMonitor.status
+		c.record("health", "%s has sent %d bytes but received nothing for %s", iface, status.Stats.TxBytes-c.tunnelMonitor.txAtLastRx, time.Since(status.LastRxAt).Round(time.Second))
+	}
+	return stalled
+}
+
+func (c *Controller) applyKillSwitch() {
+	if c.killSwitch == nil {
+		return
+	}
+	var err error
+	if c.state == StateConnected {
+		err = c.killSwitch.lift()
+	} else {
+		err = c.killSwitch.engage(c.profile.Gateways)
+	}
+	if err != nil {
+		c.record("killswitch", "%v", err)
+	}
+}
+
+func (c *Controller) updateState() {
+	var state ControllerState
+	switch {
+	case c.sleeping:
+		state = StateSuspended
+	case c.dsidTracker.current == "":
+		state = StateWaitingForDSID
+	case c.upstreamDown && !c.openConnectProcess.running:
+		state = StateNoNetwork
+	case !c.openConnectProcess.running:
+		state = StateStopped
+	case c.openConnectProcess.attemptState.success:
+		state = StateConnected
+	default:
+		state = StateConnecting
+	}
+	if state != c.state {
+		if state == StateConnected {
+			c.gateways.success()
+			c.feedback(c.openConnectProcess.dsid, DSIDAccepted, "connected")
+		}
+		c.record("state", "state %s -> %s", c.state, state)
+		c.state = state
+		c.applyKillSwitch()
+	}
+}
+
+// run fn on the event loop goroutine so it can safely read and modify controller state
+func (c *Controller) call(fn func()) {
+	done := make(chan struct{})
+	c.commands <- func() {
+		defer close(done)
+		fn()
+	}
+	<-done
+}
+
+// run a health check and remember its outcome
+func (c *Controller) checkHealth() bool {
+	start := time.Now()
+	alive := c.healthChecker.check()
+	c.healthSamples = append(c.healthSamples, HealthSample{At: start, Ok: alive, Latency: time.Since(start)})
+	if len(c.healthSamples) > healthSampleCount {
+		c.healthSamples = c.healthSamples[len(c.healthSamples)-healthSampleCount:]
+	}
+	return alive
+}
+
+func (c *Controller) status() StatusReport {
+	p := c.openConnectProcess
+	report := StatusReport{
+		State:              c.state,
+		Profile:            c.profile.Name,
+		Url:                p.url,
+		Gateways:           c.profile.Gateways,
+		GatewayPolicy:      c.profile.GatewayPolicy,
+		Running:            p.running,
+		DryRun:             p.dryRun,
+		DSID:               maskDSID(c.dsidTracker.current),
+		DSIDSince:          c.dsidTracker.currentSince(),
+		HostAddr:           p.attemptState.hostAddr,
+		ClientAddr:         p.attemptState.clientAddr,
+		LastHealthyAt:      c.lastHealthyConnectionTime,
+		RejectedDSIDs:      c.dsidTracker.rejectedCount(),
+		HealthCheckAddress: c.healthChecker.address(),
+		Upstream:           c.upstreamReason,
+		Interface:          p.iface,
+		SessionExpiresAt:   p.attemptState.sessionExpires,
+		HealthChecks:       slices.Clone(c.healthSamples),
+	}
+	if p.running {
+		report.Pid = p.pid()
+		report.StartedAt = p.startedAt
+		report.ClientAddr6 = p.attemptState.clientAddr6
+		report.MTU = p.attemptState.mtu
+		report.DNSServers = p.attemptState.dnsServers
+		report.SearchDomains = p.attemptState.searchDomains
+		report.SplitIncludes = p.attemptState.splitIncludes
+	}
+	if link := p.attemptState.link; link != nil && p.running {
+		// what the kernel has beats what the server asked for
+		report.Interface = link.Interface
+		report.MTU = link.MTU
+		report.Routes = link.Routes
+		if report.ClientAddr6 == "" {
+			report.ClientAddr6 = link.address6()
+		}
+	}
+	if poller, err := readPollerStatus(c.dsidPath); err == nil {
+		report.Poller = poller
+	}
+	if c.tunnelMonitor != nil && c.tunnelMonitor.status != nil && p.running {
+		tunnel := *c.tunnelMonitor.status
+		report.Tunnel = &tunnel
+		if report.Interface == "" {
+			report.Interface = tunnel.Interface
+		}
+	}
+	return report
+}
+
+func (c *Controller) RegisterControlHandlers(server *ControlServer) {
+	server.Handle("status", func(args map[string]string) (any, error) {
+		var report StatusReport
+		c.call(func() { report = c.status() })
+		return report, nil
+	})
+	server.Handle("reconnect", func(args map[string]string) (any, error) {
+		var err error
+		c.call(func() {
+			if c.dsidTracker.current == "" {
+				err = errors.New("no DSID available, nothing to reconnect with")
+				return
+			}
+			c.record("reconnect", "reconnect requested over control socket")
+			c.openConnectProcess.Stop()
+			// give the new process a full grace period before judging its health
+			c.lastHealthyConnectionTime = time.Now()
+		})
+		return nil, err
+	})
+	server.Handle("profiles", func(args map[string]string) (any, error) {
+		var profiles []ProfileStatus
+		c.call(func() { profiles = c.profileStatuses() })
+		return profiles, nil
+	})
+	server.Handle("profile", func(args map[string]string) (any, error) {
+		var err error
+		c.call(func() { err = c.switchProfile(args["name"]) })
+		return nil, err
+	})
+	server.Handle("history", func(args map[string]string) (any, error) {
+		n, _ := strconv.Atoi(args["n"])
+		return c.events.recent(n), nil
+	})
+}
+
+func (c *Controller) profileStatuses() []ProfileStatus {
+	var statuses []ProfileStatus
+	for _, state := range c.profiles {
+		statuses = append(statuses, ProfileStatus{
+			Profile: state.profile,
+			Active:  state.profile.Name == c.profile.Name,
+			DSID:    maskDSID(state.dsidTracker.current),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// reload the configuration whenever changes fires. config is the configuration the controller was built from
+func (c *Controller) EnableReload(configLoader *ConfigLoader, config Config, changes <-chan struct{}) {
+	c.configLoader = configLoader
+	c.config = config
+	c.reloads = changes
+}
+
+// apply a changed config.toml. Settings that don't affect the tunnel are applied in
+// place, openconnect is only restarted when its command line would change
+func (c *Controller) reloadConfig() {
+	config, _, err := c.configLoader.Load()
+	if err != nil {
+		c.record("config", "config reload failed, keeping current settings: %v", err)
+		return
+	}
+
+	var changed []string
+	if config.Controller != c.config.Controller {
+		c.interval = time.Duration(config.Controller.IntervalSeconds) * time.Second
+		c.healthCheckGracePeriod = time.Duration(config.Controller.HealthCheckGracePeriodSeconds) * time.Second
+		c.ticker.Reset(c.interval)
+		changed = append(changed, "controller")
+	}
+	if config.HealthCheck != c.config.HealthCheck {
+		c.healthChecker = c.healthChecker.withConfig(config.HealthCheck)
+		changed = append(changed, "healthCheck")
+	}
+	if config.Preflight != c.config.Preflight {
+		c.EnablePreflight(config.Preflight)
+		changed = append(changed, "preflight")
+	}
+	if config.DsidValidation != c.config.DsidValidation || config.DsidCookiePoller.CookieName != c.config.DsidCookiePoller.CookieName {
+		c.EnableDSIDValidation(config.DsidValidation, config.DsidCookiePoller.CookieName)
+		changed = append(changed, "dsidValidation")
+	}
+	if config.OpenConnect != c.config.OpenConnect || !reflect.DeepEqual(config.Vpn, c.config.Vpn) || !reflect.DeepEqual(config.Profiles, c.config.Profiles) {
+		changed = append(changed, "openconnect")
+	}
+
+	c.updateProfiles(config.ResolveProfiles())
+	active, ok := c.profiles[c.profile.Name]
+	if !ok {
+		// the active profile was removed, fall back to the configured one
+		active = c.profiles[config.ActiveProfileName()]
+		c.record("profile", "profile %s no longer exists, switching to %s", c.profile.Name, active.profile.Name)
+	}
+	c.activate(active)
+	restart := c.openConnectProcess.reconfigure(c.processProfile(), config.OpenConnect)
+	if c.openConnectProcess.dsid != c.dsidTracker.current {
+		c.openConnectProcess.dsid = c.dsidTracker.current
+		restart = true
+	}
+	c.config = config
+	// the gateways of the active profile may have changed
+	c.applyKillSwitch()
+
+	if len(changed) == 0 {
+		c.log.Printf("config reloaded, nothing changed")
+		return
+	}
+	c.record("config", "config reloaded, applied changes to %s", strings.Join(changed, ", "))
+	if restart && c.openConnectProcess.running {
+		c.record("restart", "openconnect settings changed, restarting openconnect")
+		c.openConnectProcess.Stop()
+		c.lastHealthyConnectionTime = time.Now()
+	}
+}
+
+// run until ctx is done, then stop openconnect and lift the kill switch
+func (c *Controller) Start(ctx context.Context) {
+	c.ticker = time.NewTicker(c.interval)
+	defer c.ticker.Stop()
+	c.applyKillSwitch()
 	for {
 		select {
-		case <-ticker.C:
+		case <-ctx.Done():
+			c.shutdown()
+			return
+		case <-c.ticker.C:
 			c.eventLoop()
+		case fn := <-c.commands:
+			fn()
+		case <-c.reloads:
+			c.reloadConfig()
+		case reason := <-c.networkChanges:
+			c.networkChanged(reason)
+		case sleeping := <-c.sleepEvents:
+			c.sleepChanged(sleeping)
+		case v := <-c.validations:
+			c.dsidValidated(v)
 		}
 	}
 }
 
+func (c *Controller) shutdown() {
+	c.record("stop", "shutting down")
+	c.openConnectProcess.Stop()
+	if c.killSwitch != nil {
+		if err := c.killSwitch.lift(); err != nil {
+			c.record("killswitch", "%v", err)
+		}
+	}
+}
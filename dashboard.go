@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+	"unsafe"
+)
+
+/*
+Dashboard:
+A live view of the running manager in the terminal. Every interval it asks the
+manager for its status and recent events over the control socket, samples the tun
+device's byte counters from /sys/class/net and redraws the screen in place.
+*/
+
+const (
+	sparkBlocks   = "▁▂▃▄▅▆▇█"
+	ansiReset     = "\x1b[0m"
+	ansiBold      = "\x1b[1m"
+	ansiDim       = "\x1b[2m"
+	ansiRed       = "\x1b[31m"
+	ansiGreen     = "\x1b[32m"
+	ansiYellow    = "\x1b[33m"
+	trafficPoints = 60
+)
+
+type interfaceCounters struct {
+	at      time.Time
+	rxBytes uint64
+	txBytes uint64
+}
+
+func interfaceExists(iface string) bool {
+	_, err := os.Stat(filepath.Join("/sys/class/net", iface))
+	return err == nil
+}
+
+// tun devices in this namespace, by name
+func tunInterfaces() []string {
+	matches, _ := filepath.Glob("/sys/class/net/*/tun_flags")
+	var names []string
+	for _, match := range matches {
+		names = append(names, filepath.Base(filepath.Dir(match)))
+	}
+	sort.Strings(names)
+	return names
+}
+
+type Dashboard struct {
+	controlSocket string
+	interval      time.Duration
+	// tun device the traffic history belongs to
+	iface    string
+	counters interfaceCounters
+	rxRates  []float64
+	txRates  []float64
+}
+
+func NewDashboard(controlSocket string, interval time.Duration) *Dashboard {
+	return &Dashboard{controlSocket: controlSocket, interval: interval}
+}
+
+// redraw until ctx is done, restoring the terminal afterwards
+func (d *Dashboard) Run(ctx context.Context) error {
+	resize := make(chan os.Signal, 1)
+	signal.Notify(resize, syscall.SIGWINCH)
+	defer signal.Stop(resize)
+
+	// alternate screen, hidden cursor
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		d.draw()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-resize:
+		case <-ticker.C:
+		}
+	}
+}
+
+// the manager's tun device, read here or, when it lives in another namespace, from the
+// counters the manager reports. Without one the first tun device found
+func (d *Dashboard) sampleTraffic(report *StatusReport) {
+	var iface string
+	var stats InterfaceStats
+	var err error
+	switch {
+	case report != nil && report.Interface != "" && interfaceExists(report.Interface):
+		iface = report.Interface
+		stats, err = readInterfaceStats(iface)
+	case report != nil && report.Tunnel != nil:
+		iface, stats = report.Tunnel.Interface, report.Tunnel.Stats
+	default:
+		if names := tunInterfaces(); len(names) > 0 {
+			iface = names[0]
+			stats, err = readInterfaceStats(iface)
+		}
+	}
+	if iface != d.iface {
+		d.iface, d.counters, d.rxRates, d.txRates = iface, interfaceCounters{}, nil, nil
+	}
+	if iface == "" || err != nil {
+		return
+	}
+	counters := interfaceCounters{at: time.Now(), rxBytes: stats.RxBytes, txBytes: stats.TxBytes}
+	previous := d.counters
+	d.counters = counters
+	elapsed := counters.at.Sub(previous.at).Seconds()
+	if previous.at.IsZero() || elapsed <= 0 || counters.rxBytes < previous.rxBytes || counters.txBytes < previous.txBytes {
+		// first sample or the device was recreated
+		return
+	}
+	d.rxRates = appendRate(d.rxRates, float64(counters.rxBytes-previous.rxBytes)/elapsed)
+	d.txRates = appendRate(d.txRates, float64(counters.txBytes-previous.txBytes)/elapsed)
+}
+
+func appendRate(rates []float64, rate float64) []float64 {
+	rates = append(rates, rate)
+	if len(rates) > trafficPoints {
+		rates = rates[len(rates)-trafficPoints:]
+	}
+	return rates
+}
+
+func (d *Dashboard) draw() {
+	width, height := terminalSize()
+
+	var report StatusReport
+	statusErr := controlCall(d.controlSocket, "status", nil, &report)
+	if statusErr == nil {
+		d.sampleTraffic(&report)
+	} else {
+		d.sampleTraffic(nil)
+	}
+
+	var lines []string
+	add := func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	add("%s%s dashboard%s  %s%s%s", ansiBold, programName, ansiReset, ansiDim, time.Now().Format(time.DateTime), ansiReset)
+	add("")
+	if statusErr != nil {
+		add("%smanager not reachable:%s %v", ansiRed, ansiReset, statusErr)
+	} else {
+		lines = append(lines, dashboardStatus(report)...)
+	}
+	add("")
+	lines = append(lines, d.trafficLines(width)...)
+
+	if statusErr == nil {
+		// recent events fill the rest of the screen
+		room := height - len(lines) - 2
+		var events []Event
+		if room > 0 && controlCall(d.controlSocket, "history", map[string]string{"n": strconv.Itoa(room)}, &events) == nil {
+			add("")
+			add("%srecent events%s", ansiBold, ansiReset)
+			for _, e := range events {
+				add("%s%s%s  %-10s %s", ansiDim, e.Time.Format(time.TimeOnly), ansiReset, e.Kind, e.Message)
+			}
+		}
+	}
+
+	var frame strings.Builder
+	frame.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i >= height {
+			break
+		}
+		frame.WriteString(fitLine(line, width))
+		frame.WriteString("\x1b[K\r\n")
+	}
+	frame.WriteString("\x1b[J")
+	os.Stdout.WriteString(frame.String())
+}
+
+func dashboardStatus(s StatusReport) []string {
+	var lines []string
+	add := func(label string, format string, args ...any) {
+		lines = append(lines, fmt.Sprintf("%-12s %s", label, fmt.Sprintf(format, args...)))
+	}
+	state := string(s.State)
+	if s.Upstream != "" {
+		state += ", " + s.Upstream
+	}
+	add("state", "%s%s%s", stateColor(s.State), state, ansiReset)
+	add("profile", "%s  %s", s.Profile, s.Url)
+	add("gateway", "%s", orNone(s.HostAddr))
+	add("client ip", "%s", orNone(s.ClientAddr))
+	switch {
+	case s.SessionExpiresAt.IsZero():
+		add("session", "-")
+	case time.Until(s.SessionExpiresAt) > 0:
+		add("session", "ends in %s, at %s", time.Until(s.SessionExpiresAt).Round(time.Second), s.SessionExpiresAt.Local().Format(time.DateTime))
+	default:
+		add("session", "%sexpired at %s%s", ansiRed, s.SessionExpiresAt.Local().Format(time.DateTime), ansiReset)
+	}
+	if s.DSIDSince.IsZero() {
+		add("dsid", "%s", orNone(s.DSID))
+	} else {
+		add("dsid", "%s, seen %s ago, %d rejected", s.DSID, time.Since(s.DSIDSince).Round(time.Second), s.RejectedDSIDs)
+	}
+	switch {
+	case s.Running && s.Pid > 0:
+		add("openconnect", "running (pid %d) for %s", s.Pid, time.Since(s.StartedAt).Round(time.Second))
+	case s.Running:
+		add("openconnect", "running")
+	default:
+		add("openconnect", "not running")
+	}
+	if s.Poller != nil {
+		add("poller", "%s", s.Poller.summary())
+	} else {
+		add("poller", "no status")
+	}
+	if len(s.HealthChecks) > 0 {
+		add("health", "%s %s", healthSparkline(s.HealthChecks), healthSummary(s))
+	} else {
+		add("health", "%s", healthSummary(s))
+	}
+	return lines
+}
+
+func healthSummary(s StatusReport) string {
+	summary := fmt.Sprintf("via %s, healthy %s ago", s.HealthCheckAddress, time.Since(s.LastHealthyAt).Round(time.Second))
+	if n := len(s.HealthChecks); n > 0 {
+		last := s.HealthChecks[n-1]
+		if last.Ok {
+			summary = fmt.Sprintf("%s, %s", last.Latency.Round(time.Millisecond), summary)
+		} else {
+			summary = fmt.Sprintf("%sfailed%s, %s", ansiRed, ansiReset, summary)
+		}
+	}
+	return summary
+}
+
+func (d *Dashboard) trafficLines(width int) []string {
+	if d.iface == "" {
+		return []string{fmt.Sprintf("%-12s %s", "traffic", "no tun device")}
+	}
+	points := max(width-40, 10)
+	rate := func(rates []float64) float64 {
+		if len(rates) == 0 {
+			return 0
+		}
+		return rates[len(rates)-1]
+	}
+	return []string{
+		fmt.Sprintf("%-12s rx %s %10s/s  %10s total", d.iface, sparkline(tail(d.rxRates, points)), humanBytes(rate(d.rxRates)), humanBytes(float64(d.counters.rxBytes))),
+		fmt.Sprintf("%-12s tx %s %10s/s  %10s total", "", sparkline(tail(d.txRates, points)), humanBytes(rate(d.txRates)), humanBytes(float64(d.counters.txBytes))),
+	}
+}
+
+func stateColor(state ControllerState) string {
+	switch state {
+	case StateConnected:
+		return ansiGreen
+	case StateConnecting, StateWaitingForDSID, StateSuspended:
+		return ansiYellow
+	default:
+		return ansiRed
+	}
+}
+
+// one block per value, scaled to the largest
+func sparkline(values []float64) string {
+	peak := 0.0
+	for _, v := range values {
+		peak = max(peak, v)
+	}
+	blocks := []rune(sparkBlocks)
+	var buf strings.Builder
+	for _, v := range values {
+		level := 0
+		if peak > 0 {
+			level = int(v / peak * float64(len(blocks)-1))
+		}
+		buf.WriteRune(blocks[level])
+	}
+	return buf.String()
+}
+
+// latency of each health check, failed checks in red
+func healthSparkline(samples []HealthSample) string {
+	var latencies []float64
+	for _, sample := range samples {
+		latencies = append(latencies, float64(sample.Latency))
+	}
+	blocks := []rune(sparkline(latencies))
+	var buf strings.Builder
+	for i, sample := range samples {
+		if sample.Ok {
+			buf.WriteRune(blocks[i])
+		} else {
+			buf.WriteString(ansiRed + "×" + ansiReset)
+		}
+	}
+	return buf.String()
+}
+
+func tail(values []float64, n int) []float64 {
+	if len(values) > n {
+		return values[len(values)-n:]
+	}
+	return values
+}
+
+func humanBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// cut a line to width visible characters, keeping colour escapes intact
+func fitLine(line string, width int) string {
+	visible := 0
+	for i := 0; i < len(line); {
+		if line[i] == '\x1b' {
+			end := strings.IndexByte(line[i:], 'm')
+			if end < 0 {
+				break
+			}
+			i += end + 1
+			continue
+		}
+		if visible == width {
+			return line[:i] + ansiReset
+		}
+		_, size := utf8.DecodeRuneInString(line[i:])
+		i += size
+		visible++
+	}
+	return line
+}
+
+func terminalSize() (int, int) {
+	var ws struct {
+		rows, cols, xpixel, ypixel uint16
+	}
+	if err := ioctl(os.Stdout.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); err != nil || ws.cols == 0 {
+		return 80, 24
+	}
+	return int(ws.cols), int(ws.rows)
+}
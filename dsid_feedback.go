@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+/*
+DSID feedback:
+The manager's answer to the poller. Next to each DSID file the manager writes what
+became of the DSID it last read from it, so that the poller, which can't otherwise
+tell, knows when the user has to log in again. The DSID is only identified by its hash.
+*/
+
+type DSIDFeedbackStatus string
+
+const (
+	DSIDAccepted DSIDFeedbackStatus = "accepted"
+	DSIDRejected DSIDFeedbackStatus = "rejected"
+	// the session's authentication expired while it was in use
+	DSIDExpired DSIDFeedbackStatus = "expired"
+)
+
+type DSIDFeedback struct {
+	DSIDHash string             `json:"dsidHash"`
+	Status   DSIDFeedbackStatus `json:"status"`
+	Reason   string             `json:"reason,omitempty"`
+	At       time.Time          `json:"at"`
+}
+
+func dsidFeedbackPath(dsidFile string) string {
+	return dsidFile + ".feedback"
+}
+
+func writeDSIDFeedback(dsidFile string, dsid string, status DSIDFeedbackStatus, reason string) error {
+	data, err := json.MarshalIndent(DSIDFeedback{DSIDHash: dsidHash(dsid), Status: status, Reason: reason, At: time.Now()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// readable by the poller, which runs as the user
+	return writeFileAtomic(dsidFeedbackPath(dsidFile), data, 0644)
+}
+
+func readDSIDFeedback(dsidFile string) (DSIDFeedback, error) {
+	var feedback DSIDFeedback
+	data, err := os.ReadFile(dsidFeedbackPath(dsidFile))
+	if err != nil {
+		return feedback, err
+	}
+	err = json.Unmarshal(data, &feedback)
+	return feedback, err
+}
@@ -17,3 +17,7 @@ func (fp *DSIDFileReader) ReadDSID() (string, error) {
 	return string(bytes), err
 }
 
+
+func (fp *DSIDFileReader) WriteDSID(dsid string) error {
+	return writeFileAtomic(fp.file, []byte(dsid), 0600)
+}
@@ -2,70 +2,345 @@ package main
 
 import (
 	"fmt"
-	"time"
-	"os"
+	"io"
 	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
 
 	"github.com/browserutils/kooky"
 	_ "github.com/browserutils/kooky/browser/all" // register cookie store finders!
 	"github.com/browserutils/kooky/browser/chrome"
+	"github.com/browserutils/kooky/browser/chromium"
 )
 
+/*
+DSIDCookiePoller:
+Reads the DSID cookie from the browser's cookie databases whenever the browser writes
+to one, as seen by inotify on the database and its journal, and at a slow fallback
+interval in case an event was missed. A database is copied before it is read so the
+browser never finds it locked by us. With several browser profiles, the DSID cookie of
+the most recently written database wins, the cookie library has no creation times.
+*/
+
+// quiet time after the last write to the cookie database before it is read
+const cookieDebounce = 500 * time.Millisecond
+
 type DSIDCookiePoller struct {
-	cookiePath string
-	domain     string
-	cookieName string
-	tmpFile    string
-	lastDSID   string
-	log        *log.Logger
+	sources           []BrowserProfile
+	cookieName        string
+	onRejectedCommand string
+	targets           []*dsidTarget
+	changes           chan struct{}
+	// the poller's status is written next to the default profile's DSID file
+	dsidPath      string
+	lastSuccessAt time.Time
+	errors        *pollerErrorLog
+	log           *log.Logger
+}
+
+// where the DSID of one profile is looked up and written to
+type dsidTarget struct {
+	profile  string
+	url      string
+	domain   string
+	tmpFile  string
+	store    DSIDStore
+	lastDSID string
+	// time of the last feedback from the manager that was acted on
+	feedbackAt time.Time
 }
 
-func NewDSIDCookiePoller(config DsidCookiePollerConfig, tmpFile string) *DSIDCookiePoller {
-	return &DSIDCookiePoller {
-		cookiePath: config.CookiePath,
-		domain: config.CookieHost,
-		cookieName: config.CookieName,
-	  tmpFile: tmpFile,
-		log: log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile),
+// a DSID cookie and the browser profile it was found in
+type foundDSID struct {
+	value string
+	// modification time of the cookie database
+	written time.Time
+	source  string
+}
+
+func NewDSIDCookiePoller(config DsidCookiePollerConfig, storeConfig DsidStoreConfig, sources []BrowserProfile, profiles []Profile, dsidPath string) *DSIDCookiePoller {
+	poller := &DSIDCookiePoller{
+		sources:           sources,
+		cookieName:        config.CookieName,
+		onRejectedCommand: config.OnRejectedCommand,
+		changes:           make(chan struct{}, 1),
+		dsidPath:          dsidPath,
+		log:               log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile),
+	}
+	poller.errors = newPollerErrorLog(pollerErrorInterval, poller.log)
+	for _, profile := range profiles {
+		poller.targets = append(poller.targets, &dsidTarget{
+			profile: profile.Name,
+			url:     profile.Url,
+			domain:  profile.CookieHost,
+			tmpFile: profileDSIDPath(dsidPath, profile.Name),
+			store:   NewDSIDStore(storeConfig, dsidPath, profile.Name),
+		})
 	}
+	return poller
 }
 
-func (poller *DSIDCookiePoller) openCookies() kooky.CookieSeq {
-	return chrome.TraverseCookies(poller.cookiePath).OnlyCookies()
+// cookies named cookieName, only those are decrypted
+func (poller *DSIDCookiePoller) openCookies(browser string, path string) kooky.CookieSeq {
+	switch browser {
+	case "chromium":
+		return chromium.TraverseCookies(path, kooky.Name(poller.cookieName))
+	default:
+		return chrome.TraverseCookies(path, kooky.Name(poller.cookieName))
+	}
 }
 
-func (poller *DSIDCookiePoller) get() (string, error) {
-	for cookie := range poller.openCookies() {
-		if cookie.Domain == poller.domain && cookie.Name == poller.cookieName {
-			return cookie.Value, nil
+// copy the cookie database into a private temporary directory. The sqlite reader
+// ignores journals, so the main file holds everything it would read
+func (poller *DSIDCookiePoller) copyCookies(cookiePath string) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "ocmon-cookies-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	src, err := os.Open(cookiePath)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	defer src.Close()
+	path := filepath.Join(dir, filepath.Base(cookiePath))
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return path, cleanup, nil
+}
+
+// DSID of every domain we are interested in, reading each cookie database once. Fails
+// only when no database could be read
+func (poller *DSIDCookiePoller) get(result *pollResult) (map[string]foundDSID, *PollerError) {
+	found := make(map[string]foundDSID)
+	var failed *PollerError
+	read := 0
+	for _, source := range poller.sources {
+		sourceResult := sourceResult{source: source.String(), path: source.CookiePath}
+		key := "cookie database"
+		if len(poller.sources) > 1 {
+			key += " " + source.String()
 		}
+		if err := poller.read(source, found, &sourceResult); err != nil {
+			poller.errors.report(key, err)
+			sourceResult.err = err
+			failed = err
+		} else {
+			poller.errors.clear(key)
+			read++
+		}
+		result.sources = append(result.sources, sourceResult)
+	}
+	if read == 0 {
+		return found, failed
 	}
-	return "", fmt.Errorf("[parent] DSID not found for domain %q", poller.domain)
+	return found, nil
 }
 
-func (p *DSIDCookiePoller) pollAndSave() {
-	if dsid, err := p.get(); err == nil {
-		if dsid != p.lastDSID {
-			p.log.Printf("Found new DSID = %s, old dsid = %s, writing to %s\n", dsid, p.lastDSID, p.tmpFile)
-			err = os.WriteFile(p.tmpFile, []byte(dsid), 0600)
-			if err != nil {
-				fmt.Errorf("Error writing DSID")
+func (poller *DSIDCookiePoller) read(source BrowserProfile, found map[string]foundDSID, result *sourceResult) *PollerError {
+	info, err := os.Stat(source.CookiePath)
+	if err != nil {
+		return classifyCookieError(err)
+	}
+	path, cleanup, err := poller.copyCookies(source.CookiePath)
+	if err != nil {
+		return classifyCookieError(err)
+	}
+	defer cleanup()
+	for cookie, err := range poller.openCookies(source.Browser, path) {
+		if err != nil {
+			classified := classifyCookieError(err)
+			if classified.Kind != PollerDecryptionFailed {
+				return classified
+			}
+			// other cookies may still be readable
+			if result.decryptErrors == 0 {
+				result.decryptExample = err.Error()
+			}
+			result.decryptErrors++
+			continue
+		}
+		result.domains = append(result.domains, cookie.Domain)
+		for _, target := range poller.targets {
+			if cookie.Domain != target.domain {
+				continue
+			}
+			if previous, ok := found[target.domain]; !ok || info.ModTime().After(previous.written) {
+				found[target.domain] = foundDSID{value: cookie.Value, written: info.ModTime(), source: source.String()}
 			}
-			p.lastDSID = dsid
 		}
+	}
+	return nil
+}
+
+// read the cookie database, publish new DSIDs and report how it went
+func (p *DSIDCookiePoller) pollAndSave() pollResult {
+	result := pollResult{
+		cookieName:  p.cookieName,
+		status:      PollerStatus{At: time.Now(), Healthy: true},
+		written:     make(map[string]bool),
+		maskedDSIDs: make(map[string]string),
+	}
+	found, err := p.get(&result)
+	if err != nil {
+		result.status.Healthy = false
+		result.status.Error = err
+	} else {
+		for _, target := range p.targets {
+			result.status.Profiles = append(result.status.Profiles, p.save(target, found, &result))
+		}
+	}
+	for _, profile := range result.status.Profiles {
+		if profile.Error != nil && profile.Error.Kind != PollerCookieNotFound {
+			result.status.Healthy = false
+		}
+	}
+	if result.status.Healthy {
+		p.lastSuccessAt = result.status.At
+	}
+	result.status.LastSuccessAt = p.lastSuccessAt
+	if err := writePollerStatus(p.dsidPath, result.status); err != nil {
+		p.errors.report("poller status", newPollerError(PollerWriteFailed, "%v", err))
+	}
+	return result
+}
+
+// publish the DSID found for target if it changed
+func (p *DSIDCookiePoller) save(target *dsidTarget, found map[string]foundDSID, result *pollResult) PollerProfileStatus {
+	status := PollerProfileStatus{Profile: target.profile, Domain: target.domain}
+	key := "profile " + target.profile
+	cookie, ok := found[target.domain]
+	if !ok {
+		status.Error = newPollerError(PollerCookieNotFound, "no %s cookie for %s", p.cookieName, target.domain)
+		if decryptErrors := result.decryptErrors(); decryptErrors > 0 {
+			status.Error = newPollerError(PollerDecryptionFailed, "%d %s cookies could not be decrypted, one may be for %s", decryptErrors, p.cookieName, target.domain)
+		}
+		p.errors.report(key, status.Error)
+		return status
+	}
+	dsid := cookie.value
+	status.Found = true
+	status.Source = cookie.source
+	result.maskedDSIDs[target.profile] = maskDSID(dsid)
+	if dsid != target.lastDSID {
+		p.log.Printf("Found new DSID = %s, old dsid = %s, profile = %s, browser profile = %s\n", maskDSID(dsid), maskDSID(target.lastDSID), target.profile, cookie.source)
+		if err := target.store.WriteDSID(dsid); err != nil {
+			// lastDSID is kept so that the next read tries again
+			status.Error = newPollerError(PollerWriteFailed, "%v", err)
+			p.errors.report(key, status.Error)
+			return status
+		}
+		target.lastDSID = dsid
+		result.written[target.profile] = true
+	}
+	p.errors.clear(key)
+	return status
+}
+
+// act on what the manager reported about the DSID last written for target
+func (p *DSIDCookiePoller) checkFeedback(target *dsidTarget) {
+	feedback, err := readDSIDFeedback(target.tmpFile)
+	if err != nil || !feedback.At.After(target.feedbackAt) {
+		return
+	}
+	target.feedbackAt = feedback.At
+	if target.lastDSID == "" || feedback.DSIDHash != dsidHash(target.lastDSID) {
+		// about a DSID the browser no longer has
+		return
+	}
+	p.log.Printf("manager reports DSID %s of profile %s as %s (%s)", maskDSID(target.lastDSID), target.profile, feedback.Status, feedback.Reason)
+	if feedback.Status == DSIDAccepted || p.onRejectedCommand == "" {
 		return
 	}
+	cmd := exec.Command("/bin/sh", "-c", p.onRejectedCommand)
+	cmd.Env = append(os.Environ(),
+		"OCMON_PROFILE="+target.profile,
+		"OCMON_URL="+target.url,
+		"OCMON_DSID_STATUS="+string(feedback.Status),
+		"OCMON_REASON="+feedback.Reason,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		p.log.Printf("could not run onRejectedCommand: %v", err)
+		return
+	}
+	go cmd.Wait()
+}
+
+// signal a change of a cookie database, files named after one are its journals
+func (p *DSIDCookiePoller) watch() error {
+	names := make(map[string][]string)
+	for _, source := range p.sources {
+		dir, name := filepath.Split(source.CookiePath)
+		if dir == "" {
+			dir = "."
+		}
+		names[dir] = append(names[dir], name, name+"-journal", name+"-wal")
+	}
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE)
+	for dir, watched := range names {
+		err := watchDirectory(dir, mask, p.log, func(changed string) {
+			if slices.Contains(watched, changed) {
+				select {
+				case p.changes <- struct{}{}:
+				default:
+				}
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", dir, err)
+		}
+	}
+	return nil
 }
 
-func (p *DSIDCookiePoller) Start(interval time.Duration) {
-	ticker := time.NewTicker(interval)
+// read the cookie databases when they change and every fallback, or every interval when
+// they cannot be watched. Feedback from the manager is checked every interval
+func (p *DSIDCookiePoller) Start(interval time.Duration, fallback time.Duration) {
+	for _, source := range p.sources {
+		p.log.Printf("reading %s cookies of %s from %s", p.cookieName, source, source.CookiePath)
+	}
+	if err := p.watch(); err != nil {
+		p.log.Printf("not watching the cookie databases for changes, reading them every %s: %v", interval, err)
+		fallback = interval
+	}
+	p.pollAndSave()
+
+	ticker := time.NewTicker(fallback)
 	defer ticker.Stop()
+	feedback := time.NewTicker(interval)
+	defer feedback.Stop()
+	settle := time.NewTimer(cookieDebounce)
+	settle.Stop()
 	for {
 		select {
+		case <-p.changes:
+			settle.Reset(cookieDebounce)
+		case <-settle.C:
+			p.pollAndSave()
 		case <-ticker.C:
 			p.pollAndSave()
+		case <-feedback.C:
+			for _, target := range p.targets {
+				p.checkFeedback(target)
+			}
 		}
 	}
 }
-
-
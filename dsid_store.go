@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	ss "github.com/zalando/go-keyring/secret_service"
+)
+
+/*
+DSIDStore:
+Where the poller publishes the DSID of each profile and the manager picks it up. The
+file backend is the DSID file, <dsid_path> or <dsid_path>.<profile>. The kernel keyring
+and Secret Service backends keep the DSID off the disk, in the user keyring or the
+user's default collection. A manager running as root can reach neither the user's
+keyring nor their session bus, so it reads through the `dsid get` command run as
+[dsidStore].user instead, see userDSIDStore.
+*/
+
+type DSIDStore interface {
+	ReadDSID() (string, error)
+	WriteDSID(dsid string) error
+}
+
+const (
+	dsidStoreFile          = "file"
+	dsidStoreKeyring       = "keyring"
+	dsidStoreSecretService = "secret-service"
+)
+
+var dsidStoreBackends = []string{dsidStoreFile, dsidStoreKeyring, dsidStoreSecretService}
+
+func NewDSIDStore(config DsidStoreConfig, dsidPath string, profile string) DSIDStore {
+	switch config.Backend {
+	case dsidStoreKeyring:
+		return &keyringDSIDStore{description: programName + ":" + profile}
+	case dsidStoreSecretService:
+		return &secretServiceDSIDStore{profile: profile}
+	default:
+		return NewDSIDFileReader(profileDSIDPath(dsidPath, profile))
+	}
+}
+
+// from linux/keyctl.h, not exported by syscall
+const (
+	keySpecUserKeyring = -4
+	keyctlSetPerm      = 5
+	keyctlUnlink       = 9
+	keyctlSearch       = 10
+	keyctlRead         = 11
+	// possessor everything, owner view, read, write and search
+	keyPerm = 0x3f0f0000
+)
+
+// a "user" key in the user keyring. Owner read is granted so that the manager's
+// `dsid get`, which isn't in the user's session, can read it too
+type keyringDSIDStore struct {
+	description string
+}
+
+func (k *keyringDSIDStore) WriteDSID(dsid string) error {
+	keyType, _ := syscall.BytePtrFromString("user")
+	description, err := syscall.BytePtrFromString(k.description)
+	if err != nil {
+		return err
+	}
+	payload := []byte(dsid)
+	if len(payload) == 0 {
+		return errors.New("empty DSID")
+	}
+	keyring := keySpecUserKeyring
+	id, _, errno := syscall.Syscall6(syscall.SYS_ADD_KEY, uintptr(unsafe.Pointer(keyType)), uintptr(unsafe.Pointer(description)),
+		uintptr(unsafe.Pointer(&payload[0])), uintptr(len(payload)), uintptr(keyring), 0)
+	if errno != 0 {
+		return fmt.Errorf("add_key %s: %w", k.description, errno)
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_KEYCTL, keyctlSetPerm, id, keyPerm); errno != 0 {
+		return fmt.Errorf("keyctl setperm %s: %w", k.description, errno)
+	}
+	return nil
+}
+
+func (k *keyringDSIDStore) ReadDSID() (string, error) {
+	id, err := k.search()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4096)
+	size, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, keyctlRead, id, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0, 0)
+	if errno != 0 {
+		return "", fmt.Errorf("keyctl read %s: %w", k.description, errno)
+	}
+	if int(size) > len(buf) {
+		return "", fmt.Errorf("key %s is larger than %d bytes", k.description, len(buf))
+	}
+	return string(buf[:size]), nil
+}
+
+func (k *keyringDSIDStore) remove() error {
+	id, err := k.search()
+	if err != nil {
+		return err
+	}
+	keyring := keySpecUserKeyring
+	if _, _, errno := syscall.Syscall(syscall.SYS_KEYCTL, keyctlUnlink, id, uintptr(keyring)); errno != 0 {
+		return fmt.Errorf("keyctl unlink %s: %w", k.description, errno)
+	}
+	return nil
+}
+
+func (k *keyringDSIDStore) search() (uintptr, error) {
+	keyType, _ := syscall.BytePtrFromString("user")
+	description, err := syscall.BytePtrFromString(k.description)
+	if err != nil {
+		return 0, err
+	}
+	keyring := keySpecUserKeyring
+	id, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, keyctlSearch, uintptr(keyring), uintptr(unsafe.Pointer(keyType)), uintptr(unsafe.Pointer(description)), 0, 0)
+	if errno != 0 {
+		return 0, fmt.Errorf("key %s: %w", k.description, errno)
+	}
+	return id, nil
+}
+
+// an item of the default collection, found by its service and profile attributes
+type secretServiceDSIDStore struct {
+	profile string
+}
+
+func (s *secretServiceDSIDStore) attributes() map[string]string {
+	return map[string]string{"service": programName, "profile": s.profile}
+}
+
+func (s *secretServiceDSIDStore) WriteDSID(dsid string) error {
+	svc, err := ss.NewSecretService()
+	if err != nil {
+		return err
+	}
+	session, err := svc.OpenSession()
+	if err != nil {
+		return err
+	}
+	defer svc.Close(session)
+	collection := svc.GetLoginCollection()
+	if err := svc.Unlock(collection.Path()); err != nil {
+		return err
+	}
+	label := fmt.Sprintf("%s DSID for profile %s", programName, s.profile)
+	return svc.CreateItem(collection, label, s.attributes(), ss.NewSecret(session.Path(), dsid))
+}
+
+func (s *secretServiceDSIDStore) ReadDSID() (string, error) {
+	svc, err := ss.NewSecretService()
+	if err != nil {
+		return "", err
+	}
+	session, err := svc.OpenSession()
+	if err != nil {
+		return "", err
+	}
+	defer svc.Close(session)
+	collection := svc.GetLoginCollection()
+	items, err := svc.SearchItems(collection, s.attributes())
+	if err != nil {
+		return "", err
+	}
+	if len(items) == 0 {
+		return "", fmt.Errorf("no DSID for profile %s in the secret service", s.profile)
+	}
+	if err := svc.Unlock(collection.Path()); err != nil {
+		return "", err
+	}
+	secret, err := svc.GetSecret(items[0], session.Path())
+	if err != nil {
+		return "", err
+	}
+	return string(secret.Value), nil
+}
+
+func (s *secretServiceDSIDStore) remove() error {
+	svc, err := ss.NewSecretService()
+	if err != nil {
+		return err
+	}
+	items, err := svc.SearchItems(svc.GetLoginCollection(), s.attributes())
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := svc.Delete(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+userDSIDStore:
+Reads another user's keyring or Secret Service by running `dsid get` as that user,
+with their session bus in the environment. The controller asks on every tick, so the
+result is kept until the poller writes its status file, which it does after every
+read of the cookie database, or for userDSIDStoreInterval otherwise.
+*/
+
+const userDSIDStoreInterval = time.Minute
+
+type userDSIDStore struct {
+	command []string
+	account *user.User
+	// the poller's status file, see pollerStatusPath
+	statusPath string
+
+	// state variables
+	dsid        string
+	err         error
+	readAt      time.Time
+	statusMtime time.Time
+}
+
+func newUserDSIDStore(command []string, account *user.User, statusPath string) *userDSIDStore {
+	return &userDSIDStore{command: command, account: account, statusPath: statusPath}
+}
+
+func (u *userDSIDStore) ReadDSID() (string, error) {
+	var statusMtime time.Time
+	if info, err := os.Stat(u.statusPath); err == nil {
+		statusMtime = info.ModTime()
+	}
+	if !u.readAt.IsZero() && time.Since(u.readAt) < userDSIDStoreInterval && statusMtime.Equal(u.statusMtime) {
+		return u.dsid, u.err
+	}
+	u.dsid, u.err = u.run()
+	u.readAt = time.Now()
+	u.statusMtime = statusMtime
+	return u.dsid, u.err
+}
+
+func (u *userDSIDStore) run() (string, error) {
+	uid, _ := strconv.Atoi(u.account.Uid)
+	gid, _ := strconv.Atoi(u.account.Gid)
+	runtimeDir := fmt.Sprintf("/run/user/%d", uid)
+	cmd := exec.Command(u.command[0], u.command[1:]...)
+	cmd.Env = []string{
+		"HOME=" + u.account.HomeDir,
+		"USER=" + u.account.Username,
+		"XDG_RUNTIME_DIR=" + runtimeDir,
+		"DBUS_SESSION_BUS_ADDRESS=unix:path=" + runtimeDir + "/bus",
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("dsid get as %s: %w: %s", u.account.Username, err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+func (u *userDSIDStore) WriteDSID(string) error {
+	return errors.New("the manager does not write DSIDs")
+}
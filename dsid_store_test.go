@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// `dsid get` is only run again once the poller has written its status or the interval
+// has passed
+func TestUserDSIDStoreCache(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("running a command as another user needs root")
+	}
+	account, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	script := filepath.Join(dir, "dsid-get")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho run >> "+runs+"\necho -n dsid-$(wc -l < "+runs+")\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	statusPath := filepath.Join(dir, "dsid.poller")
+	store := newUserDSIDStore([]string{script}, account, statusPath)
+
+	read := func(want string) {
+		t.Helper()
+		dsid, err := store.ReadDSID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(dsid) != want {
+			t.Fatalf("ReadDSID() = %q, want %q", dsid, want)
+		}
+	}
+	read("dsid-1")
+	read("dsid-1")
+
+	// the poller read the cookie database
+	if err := os.WriteFile(statusPath, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	read("dsid-2")
+	read("dsid-2")
+
+	store.readAt = store.readAt.Add(-userDSIDStoreInterval)
+	read("dsid-3")
+}
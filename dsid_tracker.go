@@ -1,13 +1,57 @@
 package main
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+/*
+DSIDTracker:
+Remembers which DSIDs were seen and which were rejected, so that a rejected cookie is
+never retried. DSIDs are only kept as SHA-256 hashes. Entries not seen for longer than
+the TTL are forgotten and the oldest are dropped beyond the size cap. With a state file
+the entries survive restarts of the manager.
+*/
+
+type dsidEntry struct {
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	// zero while the DSID has not been rejected or replaced by a newer one
+	RejectedAt time.Time `json:"rejectedAt,omitempty"`
+	Rejections int       `json:"rejections,omitempty"`
+}
+
+func (e *dsidEntry) rejected() bool {
+	return !e.RejectedAt.IsZero()
+}
+
 type DSIDTracker struct {
-	rejected map[string]int
-	current  string
+	// by dsidHash
+	entries    map[string]*dsidEntry
+	current    string
+	ttl        time.Duration
+	maxEntries int
+	stateFile  string
+	log        *log.Logger
 }
 
-func NewDSIDTracker() *DSIDTracker {
-	t := &DSIDTracker{rejected: make(map[string]int)}
-	t.rejected[""]++
+// stateFile may be empty to keep the entries in memory only
+func NewDSIDTracker(config DsidTrackerConfig, stateFile string) *DSIDTracker {
+	t := &DSIDTracker{
+		entries:    make(map[string]*dsidEntry),
+		ttl:        time.Duration(config.TtlHours) * time.Hour,
+		maxEntries: config.MaxEntries,
+		stateFile:  stateFile,
+		log:        log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile),
+	}
+	if err := t.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.log.Printf("ignoring DSID state %s: %v", stateFile, err)
+	}
 	return t
 }
 
@@ -19,27 +63,156 @@ const (
 	Active
 )
 
+func dsidHash(dsid string) string {
+	sum := sha256.Sum256([]byte(dsid))
+	return hex.EncodeToString(sum[:])
+}
+
 func (t *DSIDTracker) notify(dsid string) DSIDStatus {
+	if dsid == "" {
+		return Rejected
+	}
+	now := time.Now()
+	hash := dsidHash(dsid)
+	entry, seen := t.entries[hash]
+	if seen {
+		entry.LastSeen = now
+	}
 	if dsid == t.current {
 		// this is and was the acive DSID
 		return Active
 	}
-	if _, ok := t.rejected[dsid]; ok {
+	if seen && entry.rejected() {
 		// dsid was previously rejected
-		t.rejected[dsid]++
+		entry.Rejections++
 		return Rejected
 	}
 	// DSID was not previously rejected and is the latest available, move the existing
 	// key into the rejected pile and set this as the new active key
-	t.rejected[t.current]++
+	t.retire(t.current, now)
+	if !seen {
+		t.entries[hash] = &dsidEntry{FirstSeen: now, LastSeen: now}
+	}
 	t.current = dsid
+	t.changed(now)
 	// accept the newest dsid as the current
 	return Accepted
 }
 
 func (t *DSIDTracker) reject(dsid string) {
-	t.rejected[dsid]++
+	if entry, seen := t.entries[dsidHash(dsid)]; seen && entry.rejected() && dsid != t.current {
+		// already known, openconnect keeps reporting it until the next start
+		return
+	}
+	now := time.Now()
+	t.retire(dsid, now)
 	if t.current == dsid {
 		t.current = ""
 	}
+	t.changed(now)
+}
+
+func (t *DSIDTracker) retire(dsid string, now time.Time) {
+	if dsid == "" {
+		return
+	}
+	hash := dsidHash(dsid)
+	entry, ok := t.entries[hash]
+	if !ok {
+		entry = &dsidEntry{FirstSeen: now, LastSeen: now}
+		t.entries[hash] = entry
+	}
+	if !entry.rejected() {
+		entry.RejectedAt = now
+	}
+	entry.Rejections++
+}
+
+// when the current DSID was first seen, zero without one
+func (t *DSIDTracker) currentSince() time.Time {
+	if t.current == "" {
+		return time.Time{}
+	}
+	if entry, ok := t.entries[dsidHash(t.current)]; ok {
+		return entry.FirstSeen
+	}
+	return time.Time{}
+}
+
+// whether notify would accept dsid as a new DSID
+func (t *DSIDTracker) candidate(dsid string) bool {
+	if dsid == "" || dsid == t.current {
+		return false
+	}
+	entry, seen := t.entries[dsidHash(dsid)]
+	return !seen || !entry.rejected()
+}
+
+// number of distinct DSIDs seen rejected
+func (t *DSIDTracker) rejectedCount() int {
+	count := 0
+	for _, entry := range t.entries {
+		if entry.rejected() {
+			count++
+		}
+	}
+	return count
+}
+
+func (t *DSIDTracker) changed(now time.Time) {
+	t.prune(now)
+	if err := t.save(); err != nil {
+		t.log.Printf("could not save DSID state: %v", err)
+	}
+}
+
+// drop expired entries, then the least recently seen ones beyond the size cap
+func (t *DSIDTracker) prune(now time.Time) {
+	current := ""
+	if t.current != "" {
+		current = dsidHash(t.current)
+	}
+	for hash, entry := range t.entries {
+		if hash != current && t.ttl > 0 && now.Sub(entry.LastSeen) > t.ttl {
+			delete(t.entries, hash)
+		}
+	}
+	for t.maxEntries > 0 && len(t.entries) > t.maxEntries {
+		oldest := ""
+		for hash, entry := range t.entries {
+			if hash != current && (oldest == "" || entry.LastSeen.Before(t.entries[oldest].LastSeen)) {
+				oldest = hash
+			}
+		}
+		if oldest == "" {
+			break
+		}
+		delete(t.entries, oldest)
+	}
+}
+
+func (t *DSIDTracker) save() error {
+	if t.stateFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(t.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.stateFile, data, 0600)
+}
+
+func (t *DSIDTracker) load() error {
+	if t.stateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(t.stateFile)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &t.entries); err != nil {
+		return err
+	}
+	t.prune(time.Now())
+	return nil
 }
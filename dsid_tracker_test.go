@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDSIDTrackerPrune(t *testing.T) {
+	now := time.Now()
+	// entries last seen the given number of hours before now
+	tests := []struct {
+		name       string
+		ttlHours   int
+		maxEntries int
+		lastSeen   map[string]int
+		current    string
+		want       []string
+	}{
+		{
+			name:     "ttl drops expired entries",
+			ttlHours: 24,
+			lastSeen: map[string]int{"a": 1, "b": 23, "c": 25, "d": 100},
+			want:     []string{"a", "b"},
+		},
+		{
+			name:     "ttl keeps the current dsid",
+			ttlHours: 24,
+			lastSeen: map[string]int{"a": 1, "old": 48},
+			current:  "old",
+			want:     []string{"a", "old"},
+		},
+		{
+			name:     "zero ttl keeps everything",
+			lastSeen: map[string]int{"a": 1, "b": 10000},
+			want:     []string{"a", "b"},
+		},
+		{
+			name:       "max entries drops the least recently seen",
+			maxEntries: 2,
+			lastSeen:   map[string]int{"a": 1, "b": 2, "c": 3, "d": 4},
+			want:       []string{"a", "b"},
+		},
+		{
+			name:       "max entries keeps the current dsid",
+			maxEntries: 2,
+			lastSeen:   map[string]int{"a": 1, "b": 2, "c": 3, "d": 4},
+			current:    "d",
+			want:       []string{"a", "d"},
+		},
+		{
+			name:       "ttl before max entries",
+			ttlHours:   24,
+			maxEntries: 2,
+			lastSeen:   map[string]int{"a": 1, "b": 30, "c": 40},
+			want:       []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewDSIDTracker(DsidTrackerConfig{TtlHours: tt.ttlHours, MaxEntries: tt.maxEntries}, "")
+			for dsid, hours := range tt.lastSeen {
+				seen := now.Add(-time.Duration(hours) * time.Hour)
+				tracker.entries[dsidHash(dsid)] = &dsidEntry{FirstSeen: seen, LastSeen: seen}
+			}
+			tracker.current = tt.current
+			tracker.prune(now)
+			if len(tracker.entries) != len(tt.want) {
+				t.Errorf("kept %d entries, want %d", len(tracker.entries), len(tt.want))
+			}
+			for _, dsid := range tt.want {
+				if _, ok := tracker.entries[dsidHash(dsid)]; !ok {
+					t.Errorf("dropped %s", dsid)
+				}
+			}
+		})
+	}
+}
+
+func TestDSIDTrackerRejections(t *testing.T) {
+	tracker := NewDSIDTracker(DsidTrackerConfig{TtlHours: 24, MaxEntries: 10}, "")
+	if status := tracker.notify("first"); status != Accepted {
+		t.Fatalf("notify(first) = %v, want Accepted", status)
+	}
+	if status := tracker.notify("first"); status != Active {
+		t.Fatalf("notify(first) again = %v, want Active", status)
+	}
+	// a newer DSID replaces the current one, which is never taken back
+	if status := tracker.notify("second"); status != Accepted {
+		t.Fatalf("notify(second) = %v, want Accepted", status)
+	}
+	if status := tracker.notify("first"); status != Rejected {
+		t.Fatalf("notify(first) after second = %v, want Rejected", status)
+	}
+	tracker.reject("second")
+	if tracker.current != "" || tracker.candidate("second") {
+		t.Fatal("rejected DSID is still current or a candidate")
+	}
+	if !tracker.candidate("third") || tracker.candidate("") {
+		t.Fatal("candidate() wrong for a new or an empty DSID")
+	}
+	if count := tracker.rejectedCount(); count != 2 {
+		t.Fatalf("rejectedCount() = %d, want 2", count)
+	}
+}
+
+// rejections survive a restart, DSIDs are only stored hashed
+func TestDSIDTrackerStateFile(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "dsid-state.json")
+	config := DsidTrackerConfig{TtlHours: 24, MaxEntries: 10}
+	tracker := NewDSIDTracker(config, stateFile)
+	tracker.notify("secret-dsid")
+	tracker.reject("secret-dsid")
+
+	restarted := NewDSIDTracker(config, stateFile)
+	if status := restarted.notify("secret-dsid"); status != Rejected {
+		t.Fatalf("notify() after restart = %v, want Rejected", status)
+	}
+	if _, ok := restarted.entries[dsidHash("secret-dsid")]; !ok || len(restarted.entries) != 1 {
+		t.Fatalf("state file entries = %v", restarted.entries)
+	}
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret-dsid") {
+		t.Fatalf("state file holds the DSID itself:\n%s", data)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+DSIDValidator:
+Checks a new DSID against the gateway before the controller gives up a working tunnel
+for it. Pulse and Network Connect gateways serve their portal home page to a valid
+session and redirect anything else to the login page, so one request without following
+redirects tells the two apart.
+*/
+
+type DSIDVerdict string
+
+const (
+	DSIDValid   DSIDVerdict = "valid"
+	DSIDInvalid DSIDVerdict = "invalid"
+	// the gateway could not be asked or gave an unexpected answer
+	DSIDUnknown DSIDVerdict = "unknown"
+)
+
+// protocols whose gateways have the portal home page
+var dsidValidationProtocols = []string{"pulse", "nc"}
+
+type DSIDValidator struct {
+	client *http.Client
+	// name the gateway's session cookie is sent under
+	cookieName string
+}
+
+func NewDSIDValidator(config DsidValidationConfig, cookieName string) *DSIDValidator {
+	return &DSIDValidator{
+		cookieName: cookieName,
+		client: &http.Client{
+			Timeout: time.Duration(config.TimeoutSeconds) * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: !config.VerifyTLS},
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (v *DSIDValidator) supports(protocol string) bool {
+	for _, supported := range dsidValidationProtocols {
+		if protocol == supported {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *DSIDValidator) validate(gateway string, dsid string) (DSIDVerdict, error) {
+	u, err := url.Parse(gateway)
+	if err != nil {
+		return DSIDUnknown, err
+	}
+	home := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/dana/home/index.cgi"}
+	req, err := http.NewRequest(http.MethodGet, home.String(), nil)
+	if err != nil {
+		return DSIDUnknown, err
+	}
+	req.AddCookie(&http.Cookie{Name: v.cookieName, Value: dsid})
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return DSIDUnknown, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return DSIDValid, nil
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		location := resp.Header.Get("Location")
+		if strings.Contains(location, "/dana-na/") || strings.Contains(location, "welcome.cgi") {
+			return DSIDInvalid, nil
+		}
+		return DSIDUnknown, fmt.Errorf("unexpected redirect to %q", location)
+	default:
+		return DSIDUnknown, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// a gateway that serves the home page to the session cookie "session-ok" under name
+func testGateway(t *testing.T, name string) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dana/home/index.cgi" {
+			http.NotFound(w, r)
+			return
+		}
+		if cookie, err := r.Cookie(name); err == nil && cookie.Value == "session-ok" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.Redirect(w, r, "/dana-na/auth/url_default/welcome.cgi", http.StatusFound)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/corp"
+}
+
+func TestDSIDValidator(t *testing.T) {
+	requireLoopback(t)
+	tests := []struct {
+		name          string
+		cookieName    string
+		gatewayCookie string
+		dsid          string
+		want          DSIDVerdict
+	}{
+		{"valid", "DSID", "DSID", "session-ok", DSIDValid},
+		{"expired", "DSID", "DSID", "session-old", DSIDInvalid},
+		{"configured cookie name", "DSSignInURL", "DSSignInURL", "session-ok", DSIDValid},
+		{"wrong cookie name", "DSID", "DSSignInURL", "session-ok", DSIDInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := NewDSIDValidator(DsidValidationConfig{TimeoutSeconds: 5}, tt.cookieName)
+			verdict, err := validator.validate(testGateway(t, tt.gatewayCookie), tt.dsid)
+			if verdict != tt.want || err != nil {
+				t.Errorf("validate() = %s, %v, want %s", verdict, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+EventLog:
+A bounded, in-memory history of the notable things the controller did (starts, stops,
+DSID changes, health check failures) so that the history subcommand can explain what
+happened without digging through the journal.
+*/
+
+type Event struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+}
+
+type EventLog struct {
+	mu     sync.Mutex
+	events []Event
+	next   int
+	full   bool
+}
+
+func NewEventLog(size int) *EventLog {
+	return &EventLog{events: make([]Event, size)}
+}
+
+func (l *EventLog) add(kind string, message string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events[l.next] = Event{Time: time.Now(), Kind: kind, Message: message}
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// the most recent n events, oldest first. n <= 0 returns everything retained
+func (l *EventLog) recent(n int) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var ordered []Event
+	if l.full {
+		ordered = append(ordered, l.events[l.next:]...)
+	}
+	ordered = append(ordered, l.events[:l.next]...)
+	if n > 0 && n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+GatewaySelector:
+Chooses which of a profile's gateway URLs openconnect connects to. All gateways share
+the same auth realm, so a DSID obtained from one works on the others. Policies:
+- failover: always prefer the first gateway, move down the list after maxFailures
+  consecutive failures
+- latency: like failover, but the list is ordered by TCP connect time whenever a new
+  round of attempts starts. Gateways are ranked in the background, until the ranking
+  arrives the configured order is used
+- round-robin: move to the next gateway after every failure and keep going from there
+Once every gateway has failed the round is over and the selector starts again, after
+a backoff that doubles with every exhausted round until a tunnel connects.
+*/
+
+const (
+	GatewayFailover   = "failover"
+	GatewayLatency    = "latency"
+	GatewayRoundRobin = "round-robin"
+)
+
+var gatewayPolicies = []string{GatewayFailover, GatewayLatency, GatewayRoundRobin}
+
+const (
+	gatewayProbeTimeout = 2 * time.Second
+	gatewayBackoffMin   = 5 * time.Second
+	gatewayBackoffMax   = 5 * time.Minute
+)
+
+type GatewaySelector struct {
+	gateways    []string
+	policy      string
+	maxFailures int
+
+	// state variables
+	order     []string
+	index     int
+	failures  int
+	tried     int
+	exhausted int
+	retryAt   time.Time
+
+	// latest background ranking not yet applied, see updateRanking
+	rankingMu sync.Mutex
+	ranking   []string
+}
+
+func NewGatewaySelector(gateways []string, policy string, maxFailures int) *GatewaySelector {
+	s := &GatewaySelector{gateways: gateways, policy: policy, maxFailures: maxFailures}
+	s.order = append([]string(nil), gateways...)
+	if policy == GatewayLatency {
+		s.rank()
+	}
+	return s
+}
+
+// rank the gateways in the background, updateRanking applies the result
+func (s *GatewaySelector) rank() {
+	if len(s.gateways) < 2 {
+		return
+	}
+	go func() {
+		ranking := rankByLatency(s.gateways)
+		s.rankingMu.Lock()
+		s.ranking = ranking
+		s.rankingMu.Unlock()
+	}()
+}
+
+// switch to a finished ranking, starting a new round at its fastest gateway. Returns
+// whether a different gateway was selected
+func (s *GatewaySelector) updateRanking() bool {
+	s.rankingMu.Lock()
+	ranking := s.ranking
+	s.ranking = nil
+	s.rankingMu.Unlock()
+	if ranking == nil {
+		return false
+	}
+	previous := s.current()
+	s.order = ranking
+	s.index = 0
+	s.failures = 0
+	s.tried = 0
+	return s.current() != previous
+}
+
+// how long to wait before connecting again after every gateway failed, zero when
+// connecting right away
+func (s *GatewaySelector) backoff() time.Duration {
+	return max(time.Until(s.retryAt), 0)
+}
+
+func (s *GatewaySelector) current() string {
+	return s.order[s.index]
+}
+
+// the current gateway delivered a working tunnel
+func (s *GatewaySelector) success() {
+	s.failures = 0
+	s.tried = 0
+	s.exhausted = 0
+	s.retryAt = time.Time{}
+}
+
+// the current gateway failed. Returns whether a different gateway was selected and
+// whether every gateway has now failed
+func (s *GatewaySelector) failure() (moved bool, exhausted bool) {
+	if len(s.order) < 2 {
+		return false, false
+	}
+	s.failures++
+	limit := s.maxFailures
+	if s.policy == GatewayRoundRobin {
+		limit = 1
+	}
+	if s.failures < limit {
+		return false, false
+	}
+
+	previous := s.current()
+	s.failures = 0
+	s.tried++
+	if s.tried >= len(s.order) {
+		// every gateway had its chance, start a new round after the backoff
+		s.tried = 0
+		exhausted = true
+		s.retryAt = time.Now().Add(min(gatewayBackoffMin<<min(s.exhausted, 16), gatewayBackoffMax))
+		s.exhausted++
+		switch s.policy {
+		case GatewayFailover:
+			s.index = 0
+		case GatewayLatency:
+			s.index = 0
+			s.rank()
+		case GatewayRoundRobin:
+			s.index = (s.index + 1) % len(s.order)
+		}
+	} else {
+		s.index = (s.index + 1) % len(s.order)
+	}
+	return s.current() != previous, exhausted
+}
+
+// gateways ordered by how quickly they accept a TCP connection, unreachable ones last
+func rankByLatency(gateways []string) []string {
+	latencies := make([]time.Duration, len(gateways))
+	var wg sync.WaitGroup
+	for i, gateway := range gateways {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			latencies[i] = dialLatency(gateway)
+		}()
+	}
+	wg.Wait()
+
+	indexes := make([]int, len(gateways))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(a, b int) bool {
+		return latencies[indexes[a]] < latencies[indexes[b]]
+	})
+	ranked := make([]string, len(gateways))
+	for i, index := range indexes {
+		ranked[i] = gateways[index]
+	}
+	return ranked
+}
+
+// time to open a TCP connection to the gateway, a very large value if it fails
+func dialLatency(gateway string) time.Duration {
+	address, err := gatewayAddress(gateway)
+	if err != nil {
+		return time.Duration(1<<63 - 1)
+	}
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", address, gatewayProbeTimeout)
+	if err != nil {
+		return time.Duration(1<<63 - 1)
+	}
+	_ = conn.Close()
+	return time.Since(start)
+}
+
+// host:port of a gateway URL, defaulting the port from the scheme
+func gatewayAddress(gateway string) (string, error) {
+	u, err := url.Parse(gateway)
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
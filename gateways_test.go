@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestGatewaySelector(t *testing.T) {
+	gateways := []string{"https://a.example.com", "https://b.example.com", "https://c.example.com"}
+	// each step is a failure ("F") or a success ("S"), followed by the gateway selected
+	// after it and, for failures, whether it moved and exhausted the round
+	type step struct {
+		event     string
+		current   string
+		moved     bool
+		exhausted bool
+	}
+	tests := []struct {
+		name        string
+		gateways    []string
+		policy      string
+		maxFailures int
+		steps       []step
+	}{
+		{
+			name:        "failover waits for maxFailures",
+			gateways:    gateways,
+			policy:      GatewayFailover,
+			maxFailures: 2,
+			steps: []step{
+				{"F", "https://a.example.com", false, false},
+				{"F", "https://b.example.com", true, false},
+				{"F", "https://b.example.com", false, false},
+				{"F", "https://c.example.com", true, false},
+				{"F", "https://c.example.com", false, false},
+				{"F", "https://a.example.com", true, true},
+			},
+		},
+		{
+			name:        "failover success resets the count",
+			gateways:    gateways,
+			policy:      GatewayFailover,
+			maxFailures: 2,
+			steps: []step{
+				{"F", "https://a.example.com", false, false},
+				{"S", "https://a.example.com", false, false},
+				{"F", "https://a.example.com", false, false},
+				{"F", "https://b.example.com", true, false},
+			},
+		},
+		{
+			name:        "round-robin moves on every failure",
+			gateways:    gateways,
+			policy:      GatewayRoundRobin,
+			maxFailures: 5,
+			steps: []step{
+				{"F", "https://b.example.com", true, false},
+				{"S", "https://b.example.com", false, false},
+				{"F", "https://c.example.com", true, false},
+				{"F", "https://a.example.com", true, false},
+				{"F", "https://b.example.com", true, true},
+			},
+		},
+		{
+			name:        "single gateway never moves",
+			gateways:    gateways[:1],
+			policy:      GatewayRoundRobin,
+			maxFailures: 1,
+			steps: []step{
+				{"F", "https://a.example.com", false, false},
+				{"F", "https://a.example.com", false, false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewGatewaySelector(tt.gateways, tt.policy, tt.maxFailures)
+			if s.current() != tt.gateways[0] {
+				t.Fatalf("starts at %s, want %s", s.current(), tt.gateways[0])
+			}
+			for i, step := range tt.steps {
+				var moved, exhausted bool
+				if step.event == "S" {
+					s.success()
+				} else {
+					moved, exhausted = s.failure()
+				}
+				if s.current() != step.current || moved != step.moved || exhausted != step.exhausted {
+					t.Fatalf("step %d (%s): at %s moved=%v exhausted=%v, want %s moved=%v exhausted=%v",
+						i, step.event, s.current(), moved, exhausted, step.current, step.moved, step.exhausted)
+				}
+			}
+		})
+	}
+}
+
+// skips the test when connections to 127.0.0.1 fail, e.g. in a network namespace
+// whose loopback is down
+func requireLoopback(t *testing.T) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("no loopback: %v", err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Skipf("no loopback: %v", err)
+	}
+	conn.Close()
+}
+
+// a local listener is ranked before a port nothing listens on
+func TestRankByLatency(t *testing.T) {
+	requireLoopback(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	up := fmt.Sprintf("https://%s/", listener.Addr())
+	down := fmt.Sprintf("https://%s/", closedAddr)
+	if got := rankByLatency([]string{down, up}); !slices.Equal(got, []string{up, down}) {
+		t.Errorf("rankByLatency() = %v, want %v", got, []string{up, down})
+	}
+
+	// ranked in the background, the configured order is used until then
+	s := NewGatewaySelector([]string{down, up}, GatewayLatency, 1)
+	if s.current() != down {
+		t.Errorf("latency policy starts at %s, want %s", s.current(), down)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.updateRanking() {
+		if time.Now().After(deadline) {
+			t.Fatal("gateways were not ranked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.current() != up {
+		t.Errorf("latency policy moved to %s, want %s", s.current(), up)
+	}
+}
+
+func TestGatewayBackoff(t *testing.T) {
+	s := NewGatewaySelector([]string{"https://a.example.com", "https://b.example.com"}, GatewayFailover, 1)
+	var backoffs []time.Duration
+	for range 3 {
+		s.failure()
+		if _, exhausted := s.failure(); !exhausted {
+			t.Fatal("round not exhausted after every gateway failed")
+		}
+		backoffs = append(backoffs, s.backoff())
+	}
+	if backoffs[0] <= 0 || backoffs[0] > gatewayBackoffMin || backoffs[1] <= gatewayBackoffMin || backoffs[2] <= 2*gatewayBackoffMin {
+		t.Errorf("backoffs %v, want them doubling from %s", backoffs, gatewayBackoffMin)
+	}
+	s.success()
+	if s.backoff() != 0 {
+		t.Errorf("backoff %s after a success, want none", s.backoff())
+	}
+}
+
+func TestGatewayAddress(t *testing.T) {
+	tests := []struct {
+		gateway string
+		want    string
+	}{
+		{"https://vpn.example.com/corp", "vpn.example.com:443"},
+		{"http://vpn.example.com", "vpn.example.com:80"},
+		{"https://vpn.example.com:8443", "vpn.example.com:8443"},
+		{"https://[2001:db8::1]/corp", "[2001:db8::1]:443"},
+	}
+	for _, tt := range tests {
+		got, err := gatewayAddress(tt.gateway)
+		if err != nil || got != tt.want {
+			t.Errorf("gatewayAddress(%q) = %q, %v, want %q", tt.gateway, got, err, tt.want)
+		}
+	}
+}
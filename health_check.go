@@ -9,19 +9,54 @@ type HealthChecker struct {
 	host    string
 	port    string
 	timeout time.Duration
+	// network namespace the tunnel lives in, empty for the host
+	namespace string
+	// SOCKS5 proxy into the tunnel in proxy mode, see EnableProxy
+	proxy string
 }
 
-func NewHealthChecker(config HealthCheckConfig) *HealthChecker {
-	return &HealthChecker{host: config.Host, port: config.Port, timeout: time.Duration(config.TimeoutSeconds) * time.Second}
+func NewHealthChecker(config HealthCheckConfig, namespace string) *HealthChecker {
+	return &HealthChecker{host: config.Host, port: config.Port, timeout: time.Duration(config.TimeoutSeconds) * time.Second, namespace: namespace}
+}
+
+// check through the SOCKS5 proxy at address, the tunnel isn't reachable otherwise
+func (healthChecker *HealthChecker) EnableProxy(address string) {
+	healthChecker.proxy = address
+}
+
+// a checker for config that reaches the tunnel the same way
+func (healthChecker *HealthChecker) withConfig(config HealthCheckConfig) *HealthChecker {
+	updated := NewHealthChecker(config, healthChecker.namespace)
+	updated.proxy = healthChecker.proxy
+	return updated
+}
+
+func (healthChecker *HealthChecker) address() string {
+	return net.JoinHostPort(healthChecker.host, healthChecker.port)
 }
 
 func (healthChecker *HealthChecker) check() bool {
-	address := net.JoinHostPort(healthChecker.host, healthChecker.port)
+	if healthChecker.namespace != "" {
+		return inNetns(healthChecker.namespace, healthChecker.dial) == nil
+	}
+	return healthChecker.dial() == nil
+}
+
+func (healthChecker *HealthChecker) dial() error {
+	address := healthChecker.address()
+	if healthChecker.proxy != "" {
+		conn, err := dialSocks5(healthChecker.proxy, address, healthChecker.timeout)
+		if err != nil {
+			return err
+		}
+		_ = conn.Close()
+		return nil
+	}
 	d := net.Dialer{Timeout: healthChecker.timeout}
 	conn, err := d.Dial("tcp", address)
 	if err != nil {
-		return false
+		return err
 	}
 	_ = conn.Close()
-	return true
+	return nil
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+PrivilegedHelper:
+The only part that needs root when [unprivileged] is enabled. It creates the persistent
+tun device owned by the configured user and answers on a socket only that user can
+open. openconnect, running as the user, forwards its vpnc-script environment here, and
+the manager asks for the network snapshot and restore around each run. Requests are
+limited to the configured tun device.
+*/
+
+const (
+	helperVpncScript = "vpnc-script"
+	helperSnapshot   = "snapshot"
+	helperVpnHost    = "vpn-host"
+	helperRestore    = "restore"
+)
+
+// environment variables openconnect sets for its vpnc-script
+var vpncEnvPrefixes = []string{"reason", "VPNGATEWAY", "TUNDEV", "INTERNAL_IP4_", "INTERNAL_IP6_", "CISCO_"}
+
+type PrivilegedHelper struct {
+	iface      string
+	socket     string
+	vpncScript VpncScriptConfig
+	restoreDNS bool
+	uid        int
+	gid        int
+	network    *NetworkRestorer
+	mu         sync.Mutex
+	log        *log.Logger
+}
+
+func NewPrivilegedHelper(config Config) (*PrivilegedHelper, error) {
+	account, err := user.Lookup(config.Unprivileged.User)
+	if err != nil {
+		return nil, err
+	}
+	uid, _ := strconv.Atoi(account.Uid)
+	gid, _ := strconv.Atoi(account.Gid)
+	return &PrivilegedHelper{
+		iface:      config.Unprivileged.Interface,
+		socket:     config.Unprivileged.HelperSocket,
+		vpncScript: config.VpncScript,
+		restoreDNS: config.NetworkRestore.Enabled,
+		uid:        uid,
+		gid:        gid,
+		network:    NewNetworkRestorer(config.NetworkRestore),
+		log:        log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile),
+	}, nil
+}
+
+func (h *PrivilegedHelper) Start() (*ControlServer, error) {
+	if err := createTun(h.iface, h.uid, h.gid); err != nil {
+		return nil, fmt.Errorf("creating tun device %s: %w", h.iface, err)
+	}
+	h.log.Printf("tun device %s ready for uid %d", h.iface, h.uid)
+
+	server := NewControlServer(h.socket)
+	server.Handle(helperVpncScript, h.serialized(h.runVpncScript))
+	server.Handle(helperSnapshot, h.serialized(func(map[string]string) (any, error) {
+		if !h.restoreDNS {
+			return nil, nil
+		}
+		return nil, h.network.save()
+	}))
+	server.Handle(helperVpnHost, h.serialized(func(args map[string]string) (any, error) {
+		h.network.setVpnHost(args["host"])
+		return nil, nil
+	}))
+	server.Handle(helperRestore, h.serialized(h.restore))
+	// only the unprivileged manager may ask for changes
+	server.SetOwner(h.uid, h.gid, 0600)
+	if err := server.Start(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// one request at a time, they all change the same device and routing table
+func (h *PrivilegedHelper) serialized(handler ControlHandler) ControlHandler {
+	return func(args map[string]string) (any, error) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return handler(args)
+	}
+}
+
+func (h *PrivilegedHelper) runVpncScript(args map[string]string) (any, error) {
+	if args["TUNDEV"] != h.iface {
+		return nil, fmt.Errorf("only %s can be configured, got %q", h.iface, args["TUNDEV"])
+	}
+	env, err := parseVpncEnv(func(name string) string { return args[name] })
+	if err != nil {
+		return nil, err
+	}
+	return nil, NewVpncScript(h.vpncScript, "", env).Run()
+}
+
+// put the network back after openconnect exited. The persistent device outlives the
+// connection, so its routes and DNS settings are dropped by taking it down
+func (h *PrivilegedHelper) restore(map[string]string) (any, error) {
+	var changes []string
+	var errs []error
+	link, err := net.InterfaceByName(h.iface)
+	if err != nil {
+		return nil, err
+	}
+	if link.Flags&net.FlagUp != 0 {
+		if resolved, err := openResolvedLink(link.Index); err == nil {
+			_ = resolved.revert()
+			resolved.Close()
+		}
+		nl, err := openNetlink()
+		if err != nil {
+			return nil, err
+		}
+		err = nl.linkDown(link.Index)
+		nl.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("taking down %s: %w", h.iface, err))
+		} else {
+			changes = append(changes, "took down "+h.iface)
+		}
+	}
+	if h.restoreDNS {
+		restored, err := h.network.restore()
+		changes = append(changes, restored...)
+		errs = append(errs, err)
+	}
+	for _, change := range changes {
+		h.log.Printf("after openconnect exit: %s", change)
+	}
+	return changes, errors.Join(errs...)
+}
+
+/*
+helperNetwork:
+The manager's side of the helper. It takes the place of a local NetworkRestorer when
+openconnect runs unprivileged.
+*/
+
+type helperNetwork struct {
+	socket string
+	log    *log.Logger
+}
+
+func newHelperNetwork(socket string) *helperNetwork {
+	return &helperNetwork{
+		socket: socket,
+		log:    log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile),
+	}
+}
+
+func (n *helperNetwork) save() error {
+	return controlCall(n.socket, helperSnapshot, nil, nil)
+}
+
+func (n *helperNetwork) setVpnHost(host string) {
+	if err := controlCall(n.socket, helperVpnHost, map[string]string{"host": host}, nil); err != nil {
+		n.log.Printf("could not pass the VPN host to the helper: %v", err)
+	}
+}
+
+func (n *helperNetwork) verify() {
+	if err := controlCall(n.socket, helperRestore, nil, nil); err != nil {
+		n.log.Printf("the helper could not fully restore the network: %v", err)
+	}
+}
+
+// the vpnc-script variables of the environment, to forward to the helper
+func vpncEnvArgs(environ []string) map[string]string {
+	args := make(map[string]string)
+	for _, entry := range environ {
+		name, value, _ := strings.Cut(entry, "=")
+		for _, prefix := range vpncEnvPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				args[name] = value
+				break
+			}
+		}
+	}
+	return args
+}
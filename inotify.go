@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"syscall"
+	"unsafe"
+)
+
+// watch a directory with inotify and call fn with the name of every entry matching
+// mask, from a background goroutine, until reading from inotify fails
+func watchDirectory(dir string, mask uint32, logger *log.Logger, fn func(name string)) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err != nil {
+				if err == syscall.EINTR {
+					continue
+				}
+				logger.Printf("inotify read error on %s: %v", dir, err)
+				return
+			}
+			for _, name := range inotifyNames(buf[:n]) {
+				fn(name)
+			}
+		}
+	}()
+	return nil
+}
+
+// names of the directory entries referenced by a buffer of inotify events
+func inotifyNames(buf []byte) []string {
+	var names []string
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		start := offset + syscall.SizeofInotifyEvent
+		end := start + int(event.Len)
+		if end > len(buf) {
+			break
+		}
+		raw := buf[start:end]
+		for i, b := range raw {
+			if b == 0 {
+				raw = raw[:i]
+				break
+			}
+		}
+		names = append(names, string(raw))
+		offset = end
+	}
+	return names
+}
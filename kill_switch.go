@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+/*
+KillSwitch:
+While the tunnel is not connected, an nftables table drops every packet leaving the
+machine except to the VPN gateways, on loopback and through the tunnel device, plus
+DHCP and neighbour discovery so the network can come back, and DNS to the host's own
+resolvers so the gateways can be looked up. The table is replaced in one
+transaction each time it is engaged and deleted when the tunnel is up or the manager
+shuts down. Rules are generated by killSwitchRules.ruleset, apart from the kernel.
+*/
+
+const killSwitchTable = "vpn_manager_killswitch"
+
+// lists the servers behind systemd-resolved's stub listener
+const resolvedUpstreamPath = "/run/systemd/resolve/resolv.conf"
+
+type killSwitchRules struct {
+	gateways     []net.IP
+	allowSubnets []*net.IPNet
+	// nameservers DNS may go to
+	resolvers []net.IP
+	// tunnel devices, nft wildcards allowed
+	interfaces []string
+}
+
+// an nft script that atomically replaces the kill switch table
+func (r killSwitchRules) ruleset() string {
+	var v4, v6 []string
+	for _, ip := range r.gateways {
+		if ip.To4() != nil {
+			v4 = append(v4, ip.String())
+		} else {
+			v6 = append(v6, ip.String())
+		}
+	}
+	var dns4, dns6 []string
+	for _, ip := range r.resolvers {
+		if ip.To4() != nil {
+			dns4 = append(dns4, ip.String())
+		} else {
+			dns6 = append(dns6, ip.String())
+		}
+	}
+	for _, subnet := range r.allowSubnets {
+		if subnet.IP.To4() != nil {
+			v4 = append(v4, subnet.String())
+		} else {
+			v6 = append(v6, subnet.String())
+		}
+	}
+
+	var buf strings.Builder
+	buf.WriteString(killSwitchRemoval())
+	fmt.Fprintf(&buf, "table inet %s {\n", killSwitchTable)
+	buf.WriteString("\tchain output {\n")
+	buf.WriteString("\t\ttype filter hook output priority 0; policy drop;\n")
+	buf.WriteString("\t\toif \"lo\" accept\n")
+	for _, iface := range r.interfaces {
+		fmt.Fprintf(&buf, "\t\toifname %q accept\n", iface)
+	}
+	if len(v4) > 0 {
+		fmt.Fprintf(&buf, "\t\tip daddr { %s } accept\n", strings.Join(v4, ", "))
+	}
+	if len(v6) > 0 {
+		fmt.Fprintf(&buf, "\t\tip6 daddr { %s } accept\n", strings.Join(v6, ", "))
+	}
+	buf.WriteString("\t\tudp sport 68 udp dport 67 accept\n")
+	buf.WriteString("\t\tudp sport 546 udp dport 547 accept\n")
+	buf.WriteString("\t\ticmpv6 type { nd-router-solicit, nd-neighbor-solicit, nd-neighbor-advert } accept\n")
+	if len(dns4) > 0 {
+		fmt.Fprintf(&buf, "\t\tip daddr { %s } meta l4proto { tcp, udp } th dport 53 accept\n", strings.Join(dns4, ", "))
+	}
+	if len(dns6) > 0 {
+		fmt.Fprintf(&buf, "\t\tip6 daddr { %s } meta l4proto { tcp, udp } th dport 53 accept\n", strings.Join(dns6, ", "))
+	}
+	buf.WriteString("\t}\n")
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// an nft script that deletes the kill switch table, whether or not it exists
+func killSwitchRemoval() string {
+	return fmt.Sprintf("table inet %s {}\ndelete table inet %s\n", killSwitchTable, killSwitchTable)
+}
+
+type KillSwitch struct {
+	allowSubnets []*net.IPNet
+	allowDns     bool
+	interfaces   []string
+	// last successful lookup of each gateway host, used while DNS is unreachable
+	addresses map[string][]net.IP
+	engaged   bool
+	log       *log.Logger
+}
+
+// iface is the tunnel device when it has a fixed name, otherwise any tun device is let
+// through
+func NewKillSwitch(config KillSwitchConfig, iface string) *KillSwitch {
+	interfaces := []string{"tun*"}
+	if iface != "" && !strings.HasPrefix(iface, "tun") {
+		interfaces = append(interfaces, iface)
+	}
+	return &KillSwitch{
+		allowSubnets: parseCIDRs(config.AllowSubnets),
+		allowDns:     config.AllowDns,
+		interfaces:   interfaces,
+		addresses:    make(map[string][]net.IP),
+		log:          log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile),
+	}
+}
+
+// block everything but the gateways, given as URLs. Called again on every profile
+// switch, config reload and gateway failover to pick up changed gateway addresses
+func (k *KillSwitch) engage(gateways []string) error {
+	rules := killSwitchRules{allowSubnets: k.allowSubnets, interfaces: k.interfaces}
+	if k.allowDns {
+		rules.resolvers = upstreamResolvers()
+	}
+	for _, gateway := range gateways {
+		u, err := url.Parse(gateway)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		host := u.Hostname()
+		if ip := net.ParseIP(host); ip != nil {
+			rules.gateways = append(rules.gateways, ip)
+			continue
+		}
+		if addresses, err := net.LookupIP(host); err == nil {
+			k.addresses[host] = addresses
+		} else if len(k.addresses[host]) == 0 {
+			k.log.Printf("kill switch: cannot resolve gateway %s: %v", host, err)
+		}
+		for _, ip := range k.addresses[host] {
+			if !slices.ContainsFunc(rules.gateways, ip.Equal) {
+				rules.gateways = append(rules.gateways, ip)
+			}
+		}
+	}
+	if err := nft(rules.ruleset()); err != nil {
+		return fmt.Errorf("engaging kill switch: %w", err)
+	}
+	if !k.engaged {
+		k.log.Printf("kill switch engaged, only %d gateway addresses are reachable", len(rules.gateways))
+	}
+	k.engaged = true
+	return nil
+}
+
+func (k *KillSwitch) lift() error {
+	if err := nft(killSwitchRemoval()); err != nil {
+		return fmt.Errorf("lifting kill switch: %w", err)
+	}
+	if k.engaged {
+		k.log.Printf("kill switch lifted")
+	}
+	k.engaged = false
+	return nil
+}
+
+// the non-loopback nameservers of resolv.conf and, with systemd-resolved, of its
+// upstream list. Loopback is let through anyway
+func upstreamResolvers() []net.IP {
+	var resolvers []net.IP
+	for _, path := range []string{resolvConfPath, resolvedUpstreamPath} {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		for _, ip := range parseNameservers(string(content)) {
+			if !ip.IsLoopback() && !slices.ContainsFunc(resolvers, ip.Equal) {
+				resolvers = append(resolvers, ip)
+			}
+		}
+	}
+	return resolvers
+}
+
+// the nameserver lines of a resolv.conf
+func parseNameservers(content string) []net.IP {
+	var nameservers []net.IP
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		// a zone, as in fe80::1%eth0, is dropped
+		address, _, _ := strings.Cut(fields[1], "%")
+		if ip := net.ParseIP(address); ip != nil {
+			nameservers = append(nameservers, ip)
+		}
+	}
+	return nameservers
+}
+
+// run an nft script
+func nft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
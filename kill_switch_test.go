@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestKillSwitchRuleset(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	tests := []struct {
+		name    string
+		rules   killSwitchRules
+		want    []string
+		notWant []string
+	}{
+		{
+			name:  "ipv4 gateway",
+			rules: killSwitchRules{gateways: []net.IP{net.ParseIP("203.0.113.5")}, interfaces: []string{"tun*"}},
+			want: []string{
+				"policy drop;",
+				"\toif \"lo\" accept\n",
+				"\toifname \"tun*\" accept\n",
+				"\tip daddr { 203.0.113.5 } accept\n",
+			},
+			notWant: []string{"ip6 daddr", "dport 53"},
+		},
+		{
+			name:    "ipv6 gateway",
+			rules:   killSwitchRules{gateways: []net.IP{net.ParseIP("2001:db8::5")}},
+			want:    []string{"\toif \"lo\" accept\n", "\tip6 daddr { 2001:db8::5 } accept\n"},
+			notWant: []string{"\tip daddr", "oifname"},
+		},
+		{
+			name: "both families and a subnet",
+			rules: killSwitchRules{
+				gateways:     []net.IP{net.ParseIP("203.0.113.5"), net.ParseIP("2001:db8::5"), net.ParseIP("203.0.113.6")},
+				allowSubnets: []*net.IPNet{lan},
+			},
+			want: []string{
+				"\tip daddr { 203.0.113.5, 203.0.113.6, 192.168.1.0/24 } accept\n",
+				"\tip6 daddr { 2001:db8::5 } accept\n",
+			},
+		},
+		{
+			name:    "no gateways",
+			rules:   killSwitchRules{},
+			want:    []string{"\toif \"lo\" accept\n", "udp sport 68 udp dport 67 accept"},
+			notWant: []string{"daddr"},
+		},
+		{
+			name: "dns allowed",
+			rules: killSwitchRules{
+				gateways:  []net.IP{net.ParseIP("203.0.113.5")},
+				resolvers: []net.IP{net.ParseIP("192.0.2.53"), net.ParseIP("2001:db8::53")},
+			},
+			want: []string{
+				"\tip daddr { 192.0.2.53 } meta l4proto { tcp, udp } th dport 53 accept\n",
+				"\tip6 daddr { 2001:db8::53 } meta l4proto { tcp, udp } th dport 53 accept\n",
+			},
+		},
+		{
+			name:    "dns not allowed",
+			rules:   killSwitchRules{gateways: []net.IP{net.ParseIP("203.0.113.5")}},
+			notWant: []string{"dport 53"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ruleset := tt.rules.ruleset()
+			if !strings.HasPrefix(ruleset, killSwitchRemoval()) {
+				t.Errorf("ruleset does not start by deleting the old table:\n%s", ruleset)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(ruleset, want) {
+					t.Errorf("ruleset lacks %q:\n%s", want, ruleset)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(ruleset, notWant) {
+					t.Errorf("ruleset has %q:\n%s", notWant, ruleset)
+				}
+			}
+		})
+	}
+}
+
+func TestParseNameservers(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"empty", "", nil},
+		{"plain", "nameserver 192.0.2.53\nnameserver 2001:db8::53\n", []string{"192.0.2.53", "2001:db8::53"}},
+		{"comments and options", "# generated\nsearch corp.example.com\noptions edns0\nnameserver 127.0.0.53\n", []string{"127.0.0.53"}},
+		{"zone", "nameserver fe80::1%eth0\n", []string{"fe80::1"}},
+		{"garbage", "nameserver\nnameserver not-an-ip\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, ip := range parseNameservers(tt.content) {
+				got = append(got, ip.String())
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("parseNameservers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
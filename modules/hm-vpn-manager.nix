@@ -1,12 +1,18 @@
 # hm-vpn-manager.nix
-{ config, lib, pkgs, vpnManager, ... }:
+{ config, lib, pkgs, vpnManager, osConfig ? null, ... }:
 
 let
   cfg = config.vpnManager;
   system = pkgs.stdenv.hostPlatform.system;
   pkg = vpnManager.packages.${system}.vpnManager;
+	# the socket of the NixOS module's manager, when home-manager runs as a NixOS module
+	controlSocket =
+		if osConfig != null then osConfig.vpnManager.controlSocket or "/run/vpn-manager.sock"
+		else "/run/vpn-manager.sock";
 	tomlFormat = pkgs.formats.toml { };
-	vpnConfigToml = tomlFormat.generate "vpn-manager-config.toml" cfg;
+	# the config loader rejects unknown keys, so drop the module-only options
+	vpnConfigToml = tomlFormat.generate "vpn-manager-config.toml"
+		(lib.recursiveUpdate (builtins.removeAttrs cfg [ "enable" "extraSettings" ]) cfg.extraSettings);
 in
 {
 
@@ -19,9 +25,6 @@ in
 		# symlink from xdg to the generated toml for the generation
 		xdg.configFile."vpn-manager/config.toml".source = vpnConfigToml;
 
-		# add btop config for vpn-btop below
-		xdg.configFile."vpn-manager/btop.config".source = ../config/btop.config;
-
     systemd.user.services.vpn-dsid-poller = {
       Unit = {
         Description = "VPN DSID cookie poller";
@@ -33,8 +36,7 @@ in
 
         # %h = home dir, so this hits $HOME/.config/vpn-manager/...
         ExecStart = ''
-          ${pkg}/bin/go-openconnect-monitor \
-            --mode=poll_cookies \
+          ${pkg}/bin/go-openconnect-monitor poll \
             --dsid_path=%h/.config/vpn-manager/.dsid \
             --config_path=%h/.config/vpn-manager/config.toml
         '';
@@ -53,8 +55,7 @@ in
         # vpn-manager
 				# runs under sudo to manage the network interface
         (pkgs.writeShellScriptBin "vpn-manager" ''
-          exec sudo "${pkg}/bin/go-openconnect-monitor" \
-						-mode=manage_openconnect \
+          exec sudo "${pkg}/bin/go-openconnect-monitor" manage \
 						-dsid_path=$XDG_CONFIG_HOME/vpn-manager/.dsid \
 						-config_path=$XDG_CONFIG_HOME/vpn-manager/config.toml \
 						"$@"
@@ -63,43 +64,35 @@ in
 				# vpn-dsid-poller
 				# runs under user account so that cookies can be decrypted using AES keys
 				(pkgs.writeShellScriptBin "vpn-dsid-poller" ''
-          exec "${pkg}/bin/go-openconnect-monitor" \
-						--mode=poll_cookies \
+          exec "${pkg}/bin/go-openconnect-monitor" poll \
 						--dsid_path="$XDG_CONFIG_HOME/vpn-manager/.dsid" \
 						--config_path="$XDG_CONFIG_HOME/vpn-manager/config.toml" \
 						"$@"
         '')
 
-				# vpn-btop
-				# runs under user account so that cookies can be decrypted using AES keys
-				(pkgs.writeShellScriptBin "vpn-btop" ''
-					#!/usr/bin/env bash
-					echo "Waiting for VPN tunnel tun0 to come up..."
-					while ! ip route show | grep tun0; do
-						sleep 1
-					done
-					btop -c $XDG_CONFIG_HOME/vpn-manager/btop.config
+				# vpn-dashboard
+				# live view of the manager, its health checks, tunnel traffic and events
+				(pkgs.writeShellScriptBin "vpn-dashboard" ''
+					exec "${pkg}/bin/go-openconnect-monitor" dashboard \
+						-control_socket=${controlSocket} \
+						"$@"
         '')
 
-				# vpn-reset-dns
-				# hard reset any lingering dns config left by the vpn
-				(pkgs.writeShellScriptBin "vpn-reset-dns" ''
-					#!/usr/bin/env bash
-					sudo tee /etc/resolv.conf >/dev/null <<'EOF'
-					nameserver 1.1.1.1
-					nameserver 8.8.8.8
-					EOF
+				# vpn-reset-network
+				# restore dns and routes from before the vpn connected, or reset dns to
+				# the fallback nameservers when there is nothing to restore
+				(pkgs.writeShellScriptBin "vpn-reset-network" ''
+					exec sudo "${pkg}/bin/go-openconnect-monitor" reset-network \
+						-config_path=$XDG_CONFIG_HOME/vpn-manager/config.toml \
+						"$@"
         '')
 
-				# vpn-manager-tmux
-				# runs under user account so that cookies can be decrypted using AES keys
-				(pkgs.writeShellScriptBin "vpn-manager-tmux" ''
-					#!/usr/bin/env bash
-					session_name="vpn"
-					tmux new-session  -d -s $session_name -n btop 'vpn-btop'
-					tmux split-window -v -t $session_name:1 'journalctl --user -u vpn-dsid-poller -f'
-					tmux split-window -v -t $session_name:1 'journalctl -u vpn-manager -f'
-					tmux attach -t $session_name
+				# vpn-exec
+				# run a program inside the vpn's network namespace, as this user
+				(pkgs.writeShellScriptBin "vpn-exec" ''
+					exec sudo "${pkg}/bin/go-openconnect-monitor" exec \
+						-config_path=$XDG_CONFIG_HOME/vpn-manager/config.toml \
+						-- "$@"
         '')
       ];
   };
@@ -22,23 +22,39 @@ in
       type = lib.types.str;
       description = "The user account where the vpn config is managed";
     };
+    unprivileged = lib.mkOption {
+      type = lib.types.bool;
+      default = false;
+      description = ''
+        Run the manager and openconnect as the user, with only a small helper running as
+        root to own the tun device. Requires [unprivileged] enabled = true and
+        user = "<user>" in config.toml.
+      '';
+    };
+    controlSocket = lib.mkOption {
+      type = lib.types.str;
+      default = if cfg.unprivileged then "/run/vpn-manager/vpn-manager.sock" else "/run/vpn-manager.sock";
+      defaultText = lib.literalExpression ''if unprivileged then "/run/vpn-manager/vpn-manager.sock" else "/run/vpn-manager.sock"'';
+      description = "The manager's control socket, also used by the home-manager vpn-dashboard";
+    };
   };
 
   config = lib.mkIf (pkg != null) {
-    # systemd system service (root)
-    systemd.services.vpn-manager = {
-      description = "VPN Manager (root openconnect controller)";
-      after = [ "network-online.target" ];
-      wants = [ "network-online.target" ];
+    # may use the control socket, for status, reconnect and the dashboard
+    users.groups.vpn-manager = { };
+    users.users.${cfg.user}.extraGroups = [ "vpn-manager" ];
+
+    # creates the tun device and configures it for the unprivileged manager
+    systemd.services.vpn-manager-helper = lib.mkIf cfg.unprivileged {
+      description = "VPN Manager privileged helper";
+      before = [ "vpn-manager.service" ];
 
       serviceConfig = {
         Type = "simple";
         User = "root";
 
         ExecStart = ''
-          ${pkg}/bin/go-openconnect-monitor \
-            -mode=manage_openconnect \
-            -dsid_path=/home/${cfg.user}/.config/vpn-manager/.dsid \
+          ${pkg}/bin/go-openconnect-monitor helper \
             -config_path=/home/${cfg.user}/.config/vpn-manager/config.toml
         '';
 
@@ -48,5 +64,35 @@ in
 
       wantedBy = [ "multi-user.target" ];
     };
+
+    # systemd system service (root, or the user when unprivileged)
+    systemd.services.vpn-manager = {
+      description = "VPN Manager (openconnect controller)";
+      after = [ "network-online.target" ] ++ lib.optional cfg.unprivileged "vpn-manager-helper.service";
+      wants = [ "network-online.target" ];
+      requires = lib.optional cfg.unprivileged "vpn-manager-helper.service";
+
+      serviceConfig = {
+        Type = "simple";
+        User = if cfg.unprivileged then cfg.user else "root";
+        # /run/vpn-manager, writable by the user for the control socket
+        RuntimeDirectory = lib.mkIf cfg.unprivileged "vpn-manager";
+
+        ExecStart = lib.concatStringsSep " " [
+          "${pkg}/bin/go-openconnect-monitor manage"
+          "-dsid_path=/home/${cfg.user}/.config/vpn-manager/.dsid"
+          "-config_path=/home/${cfg.user}/.config/vpn-manager/config.toml"
+          # owner of the keyring or secret service with [dsidStore]
+          "-set dsidStore.user=${cfg.user}"
+          "-control_group=vpn-manager"
+          "-control_socket=${cfg.controlSocket}"
+        ];
+
+        Restart = "on-failure";
+        RestartSec = 2;
+      };
+
+      wantedBy = [ "multi-user.target" ];
+    };
   };
 }
@@ -2,11 +2,83 @@
 {
   options.vpnManager = {
     enable = lib.mkEnableOption "VPN manager Go app";
+		extraSettings = lib.mkOption {
+			type = lib.types.attrs;
+			default = { };
+			description = "Additional config.toml settings, merged over the options above (e.g. preflight)";
+		};
 		vpn = {
 			url = lib.mkOption {
 				type = lib.types.str;
 				description = "Pulse VPN URL";
 			};
+			protocol = lib.mkOption {
+				type = lib.types.str;
+				default = "pulse";
+				description = "openconnect --protocol for the default profile";
+			};
+			profile = lib.mkOption {
+				type = lib.types.str;
+				default = "";
+				description = "Profile to connect to on startup, empty for the default profile";
+			};
+			gateways = lib.mkOption {
+				type = lib.types.listOf lib.types.str;
+				default = [ ];
+				description = "Alternative gateway URLs sharing the auth realm of url";
+			};
+			gatewayPolicy = lib.mkOption {
+				type = lib.types.enum [ "failover" "latency" "round-robin" ];
+				default = "failover";
+				description = "How the gateway to connect to is chosen";
+			};
+			gatewayMaxFailures = lib.mkOption {
+				type = lib.types.int;
+				default = 2;
+				description = "Consecutive failures before moving to the next gateway";
+			};
+		};
+		profiles = lib.mkOption {
+			default = { };
+			description = "Additional VPN endpoints, unset fields inherit from vpn, dsidCookiePoller and openconnect";
+			type = lib.types.attrsOf (lib.types.submodule {
+				options = {
+					url = lib.mkOption {
+						type = lib.types.str;
+						description = "VPN URL of this profile";
+					};
+					cookieHost = lib.mkOption {
+						type = lib.types.str;
+						default = "";
+						description = "Domain under which the DSID cookie is stored, defaults to the host of url";
+					};
+					protocol = lib.mkOption {
+						type = lib.types.str;
+						default = "";
+						description = "openconnect --protocol";
+					};
+					extraArgs = lib.mkOption {
+						type = lib.types.str;
+						default = "";
+						description = "Extra args to openconnect";
+					};
+					gateways = lib.mkOption {
+						type = lib.types.listOf lib.types.str;
+						default = [ ];
+						description = "Alternative gateway URLs sharing the auth realm of url";
+					};
+					gatewayPolicy = lib.mkOption {
+						type = lib.types.str;
+						default = "";
+						description = "failover, latency or round-robin, inherited from vpn when empty";
+					};
+					gatewayMaxFailures = lib.mkOption {
+						type = lib.types.int;
+						default = 0;
+						description = "Consecutive failures before moving to the next gateway, inherited from vpn when 0";
+					};
+				};
+			});
 		};
 		openconnect = {
 			verbose = lib.mkOption {
@@ -67,7 +139,23 @@
 			};
 			cookiePath = lib.mkOption {
 				type = lib.types.str;
-				description = "Path to Chrome cookies";
+				default = "";
+				description = "Path to Chrome cookies, empty to find them in the browser profiles";
+			};
+			browser = lib.mkOption {
+				type = lib.types.enum [ "" "chrome" "chromium" ];
+				default = "";
+				description = "Browser whose profiles are searched, empty for both";
+			};
+			browserProfile = lib.mkOption {
+				type = lib.types.str;
+				default = "";
+				description = "Display or directory name of the browser profile, empty for the last used one";
+			};
+			allProfiles = lib.mkOption {
+				type = lib.types.bool;
+				default = false;
+				description = "Read the cookies of every browser profile";
 			};
 			cookieHost = lib.mkOption {
 				type = lib.types.str;
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+/*
+netlinkConn:
+Just enough of rtnetlink to configure the tunnel: bring a link up or down, set its MTU, add an
+address and add or delete routes in the main table. Every request asks for an
+acknowledgement so kernel errors are returned to the caller.
+*/
+
+// from linux/rtnetlink.h, not exported by syscall
+const (
+	rtprotStatic = 4
+	iflaMTU      = 4
+	iflaNetNsFd  = 28
+)
+
+type netlinkConn struct {
+	fd  int
+	seq uint32
+}
+
+func openNetlink() (*netlinkConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("netlink socket: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("netlink bind: %w", err)
+	}
+	return &netlinkConn{fd: fd}, nil
+}
+
+func (n *netlinkConn) Close() {
+	syscall.Close(n.fd)
+}
+
+func (n *netlinkConn) linkUp(index int, mtu int) error {
+	info := syscall.IfInfomsg{Family: syscall.AF_UNSPEC, Index: int32(index), Flags: syscall.IFF_UP, Change: syscall.IFF_UP}
+	data := structBytes(&info, syscall.SizeofIfInfomsg)
+	if mtu > 0 {
+		data = appendAttr(data, iflaMTU, binary.NativeEndian.AppendUint32(nil, uint32(mtu)))
+	}
+	return n.request(syscall.RTM_NEWLINK, 0, data)
+}
+
+// taking a link down also removes every route through it
+func (n *netlinkConn) linkDown(index int) error {
+	info := syscall.IfInfomsg{Family: syscall.AF_UNSPEC, Index: int32(index), Change: syscall.IFF_UP}
+	return n.request(syscall.RTM_NEWLINK, 0, structBytes(&info, syscall.SizeofIfInfomsg))
+}
+
+// move a link of the current namespace into the namespace name
+func (n *netlinkConn) linkSetNetns(index int, name string) error {
+	target, err := os.Open(netnsPath(name))
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	info := syscall.IfInfomsg{Family: syscall.AF_UNSPEC, Index: int32(index)}
+	data := structBytes(&info, syscall.SizeofIfInfomsg)
+	data = appendAttr(data, iflaNetNsFd, binary.NativeEndian.AppendUint32(nil, uint32(target.Fd())))
+	return n.request(syscall.RTM_NEWLINK, 0, data)
+}
+
+func (n *netlinkConn) addrAdd(index int, address *net.IPNet) error {
+	family, ip := ipFamily(address.IP)
+	prefixLen, _ := address.Mask.Size()
+	msg := syscall.IfAddrmsg{Family: family, Prefixlen: uint8(prefixLen), Index: uint32(index)}
+	data := structBytes(&msg, syscall.SizeofIfAddrmsg)
+	data = appendAttr(data, syscall.IFA_LOCAL, ip)
+	data = appendAttr(data, syscall.IFA_ADDRESS, ip)
+	return n.request(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, data)
+}
+
+// a route to dst out of the link with index oif, through gateway when it is not nil
+func (n *netlinkConn) routeAdd(dst *net.IPNet, gateway net.IP, oif int) error {
+	return n.request(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, routeMessage(dst, gateway, oif))
+}
+
+func (n *netlinkConn) routeDel(dst *net.IPNet, gateway net.IP, oif int) error {
+	err := n.request(syscall.RTM_DELROUTE, 0, routeMessage(dst, gateway, oif))
+	if errors.Is(err, syscall.ESRCH) {
+		// already gone, e.g. with the link it went through
+		return nil
+	}
+	return err
+}
+
+func routeMessage(dst *net.IPNet, gateway net.IP, oif int) []byte {
+	family, ip := ipFamily(dst.IP)
+	prefixLen, _ := dst.Mask.Size()
+	rt := syscall.RtMsg{
+		Family:   family,
+		Dst_len:  uint8(prefixLen),
+		Table:    syscall.RT_TABLE_MAIN,
+		Protocol: rtprotStatic,
+		Scope:    syscall.RT_SCOPE_UNIVERSE,
+		Type:     syscall.RTN_UNICAST,
+	}
+	if gateway == nil {
+		rt.Scope = syscall.RT_SCOPE_LINK
+	}
+	data := structBytes(&rt, syscall.SizeofRtMsg)
+	data = appendAttr(data, syscall.RTA_DST, ip.Mask(dst.Mask))
+	if gateway != nil {
+		_, gw := ipFamily(gateway)
+		data = appendAttr(data, syscall.RTA_GATEWAY, gw)
+	}
+	return appendAttr(data, syscall.RTA_OIF, binary.NativeEndian.AppendUint32(nil, uint32(oif)))
+}
+
+// send one request and wait for its acknowledgement
+func (n *netlinkConn) request(msgType uint16, flags uint16, data []byte) error {
+	n.seq++
+	header := syscall.NlMsghdr{
+		Len:   uint32(syscall.SizeofNlMsghdr + len(data)),
+		Type:  msgType,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags,
+		Seq:   n.seq,
+	}
+	msg := append(structBytes(&header, syscall.SizeofNlMsghdr), data...)
+	if err := syscall.Sendto(n.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8192)
+	for {
+		count, _, err := syscall.Recvfrom(n.fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:count])
+		if err != nil {
+			return err
+		}
+		for _, reply := range msgs {
+			if reply.Header.Seq != n.seq || reply.Header.Type != syscall.NLMSG_ERROR || len(reply.Data) < 4 {
+				continue
+			}
+			if errno := -int32(binary.NativeEndian.Uint32(reply.Data)); errno != 0 {
+				return syscall.Errno(errno)
+			}
+			return nil
+		}
+	}
+}
+
+// gateway and outgoing link of the main table's default route for family
+func defaultRoute(family int) (net.IP, int, error) {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, family)
+	if err != nil {
+		return nil, 0, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.RTM_NEWROUTE || len(msg.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		rt := (*syscall.RtMsg)(unsafe.Pointer(&msg.Data[0]))
+		if rt.Dst_len != 0 || rt.Table != syscall.RT_TABLE_MAIN || rt.Type != syscall.RTN_UNICAST {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+		if err != nil {
+			continue
+		}
+		var gateway net.IP
+		var oif int
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_GATEWAY:
+				gateway = net.IP(attr.Value)
+			case syscall.RTA_OIF:
+				if len(attr.Value) >= 4 {
+					oif = int(binary.NativeEndian.Uint32(attr.Value))
+				}
+			}
+		}
+		if oif != 0 {
+			return gateway, oif, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("no default route for address family %d", family)
+}
+
+func ipFamily(ip net.IP) (uint8, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return syscall.AF_INET, ip4
+	}
+	return syscall.AF_INET6, ip.To16()
+}
+
+func structBytes[T any](v *T, size int) []byte {
+	return append([]byte(nil), unsafe.Slice((*byte)(unsafe.Pointer(v)), size)...)
+}
+
+func appendAttr(data []byte, attrType uint16, value []byte) []byte {
+	length := syscall.SizeofRtAttr + len(value)
+	data = binary.NativeEndian.AppendUint16(data, uint16(length))
+	data = binary.NativeEndian.AppendUint16(data, attrType)
+	data = append(data, value...)
+	for len(data)%syscall.NLMSG_ALIGNTO != 0 {
+		data = append(data, 0)
+	}
+	return data
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+/*
+Network namespaces:
+Named namespaces are bind mounts under /run/netns, where `ip netns` keeps them, so both
+tools see the same namespaces. Programs started in one get /etc/netns/<name>/resolv.conf
+mounted over /etc/resolv.conf, as with `ip netns exec`, which is where the vpnc-script
+writes the tunnel's nameservers.
+*/
+
+const (
+	netnsDir    = "/run/netns"
+	netnsEtcDir = "/etc/netns"
+)
+
+func netnsPath(name string) string {
+	return filepath.Join(netnsDir, name)
+}
+
+func netnsResolvConf(name string) string {
+	return filepath.Join(netnsEtcDir, name, "resolv.conf")
+}
+
+// create the namespace name with its loopback device up, unless it already exists
+func createNetns(name string) error {
+	path := netnsPath(name)
+	if err := os.MkdirAll(netnsDir, 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(netnsResolvConf(name)), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(netnsResolvConf(name)); os.IsNotExist(err) {
+		if err := os.WriteFile(netnsResolvConf(name), nil, 0644); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(path); err == nil {
+		if inNetns(name, func() error { return nil }) == nil {
+			return nil
+		}
+		// left behind by a namespace that no longer exists
+		os.Remove(path)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDONLY, 0444)
+	if err != nil {
+		return err
+	}
+	file.Close()
+	done := make(chan error)
+	go func() {
+		// the thread is left in the new namespace, so it is never unlocked and exits
+		// with the goroutine
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			done <- fmt.Errorf("unshare: %w", err)
+			return
+		}
+		source := fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid())
+		if err := syscall.Mount(source, path, "", syscall.MS_BIND, ""); err != nil {
+			done <- fmt.Errorf("mounting %s: %w", path, err)
+			return
+		}
+		done <- nil
+	}()
+	if err := <-done; err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	return inNetns(name, func() error {
+		nl, err := openNetlink()
+		if err != nil {
+			return err
+		}
+		defer nl.Close()
+		// loopback is always the first link of a new namespace
+		return nl.linkUp(1, 0)
+	})
+}
+
+// run fn on a thread that is inside the namespace name. Sockets opened by fn stay in
+// the namespace after it returns
+func inNetns(name string, fn func() error) error {
+	target, err := os.Open(netnsPath(name))
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	original, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		return err
+	}
+	defer original.Close()
+
+	done := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		if err := setns(target.Fd()); err != nil {
+			runtime.UnlockOSThread()
+			done <- fmt.Errorf("entering namespace %s: %w", name, err)
+			return
+		}
+		err := fn()
+		// a thread that can't go back is discarded with the goroutine
+		if setns(original.Fd()) == nil {
+			runtime.UnlockOSThread()
+		}
+		done <- err
+	}()
+	return <-done
+}
+
+func setns(fd uintptr) error {
+	if _, _, errno := syscall.Syscall(sysSetns, fd, syscall.CLONE_NEWNET, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// replace this process with program running inside the namespace name as uid and gid,
+// with the namespace's resolv.conf and sysfs mounted
+func execInNetns(name string, program string, args []string, env []string, uid int, gid int, groups []int) error {
+	target, err := os.Open(netnsPath(name))
+	if err != nil {
+		return fmt.Errorf("namespace %s: %w", name, err)
+	}
+	runtime.LockOSThread()
+	if err := setns(target.Fd()); err != nil {
+		return fmt.Errorf("entering namespace %s: %w", name, err)
+	}
+	target.Close()
+
+	// private mounts, so the bind mounts below only affect this process
+	if err := syscall.Unshare(syscall.CLONE_NEWNS); err != nil {
+		return fmt.Errorf("unshare mounts: %w", err)
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_SLAVE|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+	if err := syscall.Mount(netnsResolvConf(name), resolvConfPath, "", syscall.MS_BIND, ""); err != nil && !errors.Is(err, syscall.ENOENT) {
+		return fmt.Errorf("mounting %s: %w", netnsResolvConf(name), err)
+	}
+	// /sys/class/net should list the namespace's links
+	if syscall.Unmount("/sys", syscall.MNT_DETACH) == nil {
+		_ = syscall.Mount(name, "/sys", "sysfs", 0, "")
+	}
+
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	return syscall.Exec(program, args, env)
+}
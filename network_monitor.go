@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+/*
+NetworkMonitor:
+Subscribes to rtnetlink link, address and route notifications and reports when the
+default route changes, a link carrying the default route goes down or its addresses
+change, e.g. after resume, switching Wi-Fi or a new DHCP lease. Interfaces matching ignoreInterfaces (the tunnel itself) are skipped
+so that openconnect bringing up its own routes doesn't look like a network change.
+Bursts of events are collapsed into one notification.
+*/
+
+// from linux/rtnetlink.h, not exported by syscall
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6Ifaddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+	rtTableMain      = 254
+)
+
+type NetworkMonitor struct {
+	debounce         time.Duration
+	ignoreInterfaces []string
+	changes          chan string
+	events           chan string
+	log              *log.Logger
+
+	// state variables, only touched by the reading goroutine
+	defaultRouteLinks map[int32]bool
+	linkRunning       map[int32]bool
+	// names are kept after a link is deleted, its routes are removed afterwards
+	linkNames map[int32]string
+	// "address/prefix" of each link, IPv6 addresses are re-announced whenever their
+	// lifetimes are refreshed
+	linkAddrs map[int32]map[string]bool
+}
+
+func NewNetworkMonitor(config NetworkEventsConfig) *NetworkMonitor {
+	return &NetworkMonitor{
+		debounce:          time.Duration(config.DebounceMilliseconds) * time.Millisecond,
+		ignoreInterfaces:  config.IgnoreInterfaces,
+		changes:           make(chan string, 1),
+		events:            make(chan string, 64),
+		defaultRouteLinks: make(map[int32]bool),
+		linkRunning:       make(map[int32]bool),
+		linkNames:         make(map[int32]string),
+		linkAddrs:         make(map[int32]map[string]bool),
+		log:               log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile),
+	}
+}
+
+// a description of the latest burst of network changes
+func (m *NetworkMonitor) Changes() <-chan string {
+	return m.changes
+}
+
+func (m *NetworkMonitor) Start() error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("netlink socket: %w", err)
+	}
+	groups := uint32(rtmgrpLink | rtmgrpIPv4Ifaddr | rtmgrpIPv4Route | rtmgrpIPv6Ifaddr | rtmgrpIPv6Route)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("netlink bind: %w", err)
+	}
+
+	// learn the current links, which of them carry a default route and their
+	// addresses before listening for changes
+	for _, request := range []int{syscall.RTM_GETLINK, syscall.RTM_GETROUTE, syscall.RTM_GETADDR} {
+		if rib, err := syscall.NetlinkRIB(request, syscall.AF_UNSPEC); err == nil {
+			if msgs, err := syscall.ParseNetlinkMessage(rib); err == nil {
+				for _, msg := range msgs {
+					m.handle(msg, false)
+				}
+			}
+		}
+	}
+
+	go m.read(fd)
+	go m.debounceEvents()
+	return nil
+}
+
+func (m *NetworkMonitor) read(fd int) {
+	defer syscall.Close(fd)
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == syscall.EINTR || err == syscall.ENOBUFS {
+				// ENOBUFS means we missed messages, which is a change in itself
+				m.emit("netlink buffer overrun")
+				continue
+			}
+			m.log.Printf("netlink read error, no longer watching the network: %v", err)
+			return
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			m.log.Printf("netlink parse error: %v", err)
+			continue
+		}
+		for _, msg := range msgs {
+			m.handle(msg, true)
+		}
+	}
+}
+
+func (m *NetworkMonitor) handle(msg syscall.NetlinkMessage, notify bool) {
+	switch msg.Header.Type {
+	case syscall.RTM_NEWROUTE, syscall.RTM_DELROUTE:
+		if len(msg.Data) < syscall.SizeofRtMsg {
+			return
+		}
+		rt := (*syscall.RtMsg)(unsafe.Pointer(&msg.Data[0]))
+		if rt.Dst_len != 0 || rt.Type != syscall.RTN_UNICAST {
+			return
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+		if err != nil {
+			return
+		}
+		table := uint32(rt.Table)
+		var oif int32
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_TABLE:
+				if len(attr.Value) >= 4 {
+					table = binary.NativeEndian.Uint32(attr.Value)
+				}
+			case syscall.RTA_OIF:
+				if len(attr.Value) >= 4 {
+					oif = int32(binary.NativeEndian.Uint32(attr.Value))
+				}
+			}
+		}
+		if table != rtTableMain || oif == 0 {
+			return
+		}
+		name := m.linkName(oif)
+		if m.ignored(name) {
+			return
+		}
+		if msg.Header.Type == syscall.RTM_NEWROUTE {
+			m.defaultRouteLinks[oif] = true
+			if notify {
+				m.emit(fmt.Sprintf("default route added via %s", name))
+			}
+		} else {
+			delete(m.defaultRouteLinks, oif)
+			if notify {
+				m.emit(fmt.Sprintf("default route removed from %s", name))
+			}
+		}
+
+	case syscall.RTM_NEWLINK, syscall.RTM_DELLINK:
+		if len(msg.Data) < syscall.SizeofIfInfomsg {
+			return
+		}
+		info := (*syscall.IfInfomsg)(unsafe.Pointer(&msg.Data[0]))
+		if attrs, err := syscall.ParseNetlinkRouteAttr(&msg); err == nil {
+			for _, attr := range attrs {
+				if attr.Attr.Type == syscall.IFLA_IFNAME {
+					m.linkNames[info.Index] = strings.TrimRight(string(attr.Value), "\x00")
+				}
+			}
+		}
+		running := msg.Header.Type == syscall.RTM_NEWLINK && info.Flags&syscall.IFF_RUNNING != 0
+		wasRunning, known := m.linkRunning[info.Index]
+		m.linkRunning[info.Index] = running
+		if msg.Header.Type == syscall.RTM_DELLINK {
+			delete(m.linkRunning, info.Index)
+			delete(m.linkAddrs, info.Index)
+		}
+		if notify && known && wasRunning && !running && m.defaultRouteLinks[info.Index] {
+			m.emit(fmt.Sprintf("link %s carrying the default route went down", m.linkName(info.Index)))
+		}
+
+	case syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+		if len(msg.Data) < syscall.SizeofIfAddrmsg {
+			return
+		}
+		ifa := (*syscall.IfAddrmsg)(unsafe.Pointer(&msg.Data[0]))
+		if ifa.Scope == syscall.RT_SCOPE_LINK {
+			// fe80::/64 comes and goes with the link
+			return
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+		if err != nil {
+			return
+		}
+		var addr net.IP
+		for _, attr := range attrs {
+			// IFA_LOCAL is the address itself on point to point links, where IFA_ADDRESS
+			// is the peer's
+			if attr.Attr.Type == syscall.IFA_LOCAL || (attr.Attr.Type == syscall.IFA_ADDRESS && addr == nil) {
+				addr = net.IP(attr.Value)
+			}
+		}
+		index := int32(ifa.Index)
+		if addr == nil || m.ignored(m.linkName(index)) {
+			return
+		}
+		key := fmt.Sprintf("%s/%d", addr, ifa.Prefixlen)
+		addrs := m.linkAddrs[index]
+		if addrs == nil {
+			addrs = make(map[string]bool)
+			m.linkAddrs[index] = addrs
+		}
+		if msg.Header.Type == syscall.RTM_NEWADDR {
+			if addrs[key] {
+				return
+			}
+			addrs[key] = true
+			if notify && m.defaultRouteLinks[index] {
+				m.emit(fmt.Sprintf("address %s added to %s", key, m.linkName(index)))
+			}
+		} else {
+			if !addrs[key] {
+				return
+			}
+			delete(addrs, key)
+			if notify && m.defaultRouteLinks[index] {
+				m.emit(fmt.Sprintf("address %s removed from %s", key, m.linkName(index)))
+			}
+		}
+	}
+}
+
+func (m *NetworkMonitor) ignored(name string) bool {
+	for _, pattern := range m.ignoreInterfaces {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *NetworkMonitor) emit(reason string) {
+	select {
+	case m.events <- reason:
+	default:
+	}
+}
+
+func (m *NetworkMonitor) debounceEvents() {
+	for reason := range m.events {
+		timer := time.NewTimer(m.debounce)
+		count := 1
+	quiet:
+		for {
+			select {
+			case <-m.events:
+				count++
+				timer.Reset(m.debounce)
+			case <-timer.C:
+				break quiet
+			}
+		}
+		if count > 1 {
+			reason = fmt.Sprintf("%s (and %d more changes)", reason, count-1)
+		}
+		select {
+		case m.changes <- reason:
+		default:
+		}
+	}
+}
+
+func (m *NetworkMonitor) linkName(index int32) string {
+	if name, ok := m.linkNames[index]; ok {
+		return name
+	}
+	if iface, err := net.InterfaceByIndex(int(index)); err == nil {
+		return iface.Name
+	}
+	return fmt.Sprintf("if%d", index)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// an RTM_NEWADDR or RTM_DELADDR message as the kernel sends it
+func addrMessage(msgType uint16, index int32, scope uint8, cidr string) syscall.NetlinkMessage {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	family, addr := syscall.AF_INET6, ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		family, addr = syscall.AF_INET, ip4
+	}
+	prefixlen, _ := network.Mask.Size()
+	ifa := syscall.IfAddrmsg{Family: uint8(family), Prefixlen: uint8(prefixlen), Scope: scope, Index: uint32(index)}
+	data := append([]byte(nil), (*[syscall.SizeofIfAddrmsg]byte)(unsafe.Pointer(&ifa))[:]...)
+	for _, attrType := range []uint16{syscall.IFA_ADDRESS, syscall.IFA_LOCAL} {
+		attr := make([]byte, syscall.SizeofRtAttr, syscall.SizeofRtAttr+len(addr))
+		binary.NativeEndian.PutUint16(attr[0:2], uint16(syscall.SizeofRtAttr+len(addr)))
+		binary.NativeEndian.PutUint16(attr[2:4], attrType)
+		data = append(data, append(attr, addr...)...)
+	}
+	return syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Len: uint32(syscall.SizeofNlMsghdr + len(data)), Type: msgType},
+		Data:   data,
+	}
+}
+
+func TestNetworkMonitorAddresses(t *testing.T) {
+	const wlan, eth, tun = 2, 3, 4
+	newMonitor := func() *NetworkMonitor {
+		m := NewNetworkMonitor(NetworkEventsConfig{IgnoreInterfaces: []string{"tun*"}})
+		m.linkNames = map[int32]string{wlan: "wlan0", eth: "eth0", tun: "tun0"}
+		m.defaultRouteLinks[wlan] = true
+		m.defaultRouteLinks[tun] = true
+		// the addresses learnt at start
+		m.handle(addrMessage(syscall.RTM_NEWADDR, wlan, syscall.RT_SCOPE_UNIVERSE, "192.168.1.20/24"), false)
+		m.handle(addrMessage(syscall.RTM_NEWADDR, wlan, syscall.RT_SCOPE_UNIVERSE, "2001:db8::20/64"), false)
+		return m
+	}
+	tests := []struct {
+		name string
+		msgs []syscall.NetlinkMessage
+		want []string
+	}{
+		{
+			name: "new dhcp lease",
+			msgs: []syscall.NetlinkMessage{
+				addrMessage(syscall.RTM_DELADDR, wlan, syscall.RT_SCOPE_UNIVERSE, "192.168.1.20/24"),
+				addrMessage(syscall.RTM_NEWADDR, wlan, syscall.RT_SCOPE_UNIVERSE, "192.168.1.21/24"),
+			},
+			want: []string{"address 192.168.1.20/24 removed from wlan0", "address 192.168.1.21/24 added to wlan0"},
+		},
+		{
+			name: "ipv6 lifetime refresh",
+			msgs: []syscall.NetlinkMessage{addrMessage(syscall.RTM_NEWADDR, wlan, syscall.RT_SCOPE_UNIVERSE, "2001:db8::20/64")},
+		},
+		{
+			name: "link local address",
+			msgs: []syscall.NetlinkMessage{addrMessage(syscall.RTM_NEWADDR, wlan, syscall.RT_SCOPE_LINK, "fe80::20/64")},
+		},
+		{
+			name: "link without the default route",
+			msgs: []syscall.NetlinkMessage{addrMessage(syscall.RTM_NEWADDR, eth, syscall.RT_SCOPE_UNIVERSE, "10.0.0.5/24")},
+		},
+		{
+			name: "ignored tunnel",
+			msgs: []syscall.NetlinkMessage{addrMessage(syscall.RTM_NEWADDR, tun, syscall.RT_SCOPE_UNIVERSE, "10.20.30.40/32")},
+		},
+		{
+			name: "unknown address removed",
+			msgs: []syscall.NetlinkMessage{addrMessage(syscall.RTM_DELADDR, wlan, syscall.RT_SCOPE_UNIVERSE, "192.168.1.99/24")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMonitor()
+			for _, msg := range tt.msgs {
+				m.handle(msg, true)
+			}
+			var got []string
+			for len(m.events) > 0 {
+				got = append(got, <-m.events)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("events %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("event %d is %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
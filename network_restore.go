@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+NetworkRestorer:
+Snapshots /etc/resolv.conf and the main routing table before openconnect starts. The
+vpnc-script puts both back on a clean disconnect, but when openconnect is killed it
+never runs, leaving the VPN's nameservers in resolv.conf and no default route once the
+tun device is gone. After every exit the current state is compared with the snapshot
+and anything that differs is restored. The snapshot is also written to stateFile so
+that `reset-network` can restore it from another process.
+*/
+
+const resolvConfPath = "/etc/resolv.conf"
+
+// route flags reported by `ip route show` that `ip route replace` does not accept
+var routeStateFlags = []string{"linkdown", "dead", "offload", "trap", "rt_offload", "rt_trap", "rt_offload_failed", "pervasive", "notify"}
+
+// routes through the tunnel itself are not part of the network to restore
+var tunnelInterfaces = []string{"tun*"}
+
+type NetworkSnapshot struct {
+	TakenAt    time.Time `json:"takenAt"`
+	ResolvConf string    `json:"resolvConf"`
+	// symlink target of resolv.conf, e.g. systemd-resolved's stub file
+	ResolvConfLink string   `json:"resolvConfLink,omitempty"`
+	Routes4        []string `json:"routes4"`
+	Routes6        []string `json:"routes6"`
+	// gateway address openconnect connected to, the vpnc-script adds a host route for it
+	VpnHost string `json:"vpnHost,omitempty"`
+}
+
+type NetworkRestorer struct {
+	stateFile           string
+	fallbackNameservers []string
+	// the snapshot is updated from openconnect's output while an exit may restore it
+	mu       sync.Mutex
+	snapshot *NetworkSnapshot
+	log      *log.Logger
+}
+
+func NewNetworkRestorer(config NetworkRestoreConfig) *NetworkRestorer {
+	return &NetworkRestorer{
+		stateFile:           config.StateFile,
+		fallbackNameservers: config.FallbackNameservers,
+		log:                 log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile),
+	}
+}
+
+// record the current network state, called right before openconnect is started
+func (r *NetworkRestorer) save() error {
+	snapshot, err := takeNetworkSnapshot()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.snapshot = &snapshot
+	return r.write()
+}
+
+// remember the gateway address once openconnect has connected
+func (r *NetworkRestorer) setVpnHost(host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.snapshot == nil {
+		return
+	}
+	r.snapshot.VpnHost = host
+	if err := r.write(); err != nil {
+		r.log.Printf("could not update %s: %v", r.stateFile, err)
+	}
+}
+
+func (r *NetworkRestorer) write() error {
+	data, err := json.MarshalIndent(r.snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.stateFile, data, 0600)
+}
+
+// the in-memory snapshot, or the one left in stateFile by the manager
+func (r *NetworkRestorer) load() (*NetworkSnapshot, error) {
+	if r.snapshot != nil {
+		return r.snapshot, nil
+	}
+	data, err := os.ReadFile(r.stateFile)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot NetworkSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("%s: %w", r.stateFile, err)
+	}
+	r.snapshot = &snapshot
+	return r.snapshot, nil
+}
+
+// put back whatever differs from the snapshot and return a description of each change
+func (r *NetworkRestorer) restore() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	snapshot, err := r.load()
+	if err != nil {
+		return nil, fmt.Errorf("no network snapshot: %w", err)
+	}
+	var changes []string
+	var errs []error
+
+	changed, err := restoreResolvConf(snapshot)
+	if err != nil {
+		errs = append(errs, err)
+	} else if changed != "" {
+		changes = append(changes, changed)
+	}
+	// the vpnc-script's own copy is stale once the snapshot has been restored
+	_ = os.Remove(resolvConfBackupPath)
+	for _, family := range []string{"-4", "-6"} {
+		routes := snapshot.Routes4
+		if family == "-6" {
+			routes = snapshot.Routes6
+		}
+		routeChanges, err := restoreRoutes(family, routes, snapshot.VpnHost)
+		changes = append(changes, routeChanges...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return changes, errors.Join(errs...)
+}
+
+// check the network after openconnect has exited and log what had to be restored
+func (r *NetworkRestorer) verify() {
+	changes, err := r.restore()
+	if len(changes) == 0 && err == nil {
+		return
+	}
+	for _, change := range changes {
+		r.log.Printf("vpnc-script did not clean up, %s", change)
+	}
+	if err != nil {
+		r.log.Printf("could not fully restore the network: %v", err)
+	}
+}
+
+// overwrite resolv.conf with the fallback nameservers, used when there is no snapshot
+func (r *NetworkRestorer) resetResolvConf() error {
+	var buf strings.Builder
+	buf.WriteString("# written by " + programName + " reset-network\n")
+	for _, nameserver := range r.fallbackNameservers {
+		fmt.Fprintf(&buf, "nameserver %s\n", nameserver)
+	}
+	return writeResolvConf(buf.String())
+}
+
+func takeNetworkSnapshot() (NetworkSnapshot, error) {
+	snapshot := NetworkSnapshot{TakenAt: time.Now()}
+	if target, err := os.Readlink(resolvConfPath); err == nil {
+		snapshot.ResolvConfLink = target
+	}
+	content, err := os.ReadFile(resolvConfPath)
+	if err != nil && !os.IsNotExist(err) {
+		return snapshot, err
+	}
+	snapshot.ResolvConf = string(content)
+	if snapshot.Routes4, err = readRoutes("-4"); err != nil {
+		return snapshot, err
+	}
+	// hosts without IPv6 have no routes to restore
+	snapshot.Routes6, _ = readRoutes("-6")
+	return snapshot, nil
+}
+
+func restoreResolvConf(snapshot *NetworkSnapshot) (string, error) {
+	if snapshot.ResolvConfLink != "" {
+		if target, err := os.Readlink(resolvConfPath); err == nil && target == snapshot.ResolvConfLink {
+			return "", nil
+		}
+		if err := os.Remove(resolvConfPath); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if err := os.Symlink(snapshot.ResolvConfLink, resolvConfPath); err != nil {
+			return "", err
+		}
+		flushResolvedCaches()
+		return fmt.Sprintf("relinked %s to %s", resolvConfPath, snapshot.ResolvConfLink), nil
+	}
+	content, err := os.ReadFile(resolvConfPath)
+	if err == nil && string(content) == snapshot.ResolvConf {
+		return "", nil
+	}
+	if err := writeResolvConf(snapshot.ResolvConf); err != nil {
+		return "", err
+	}
+	return "restored " + resolvConfPath, nil
+}
+
+// replace the file in place rather than renaming over it, resolv.conf may be a bind mount
+func writeResolvConf(content string) error {
+	if target, err := os.Readlink(resolvConfPath); err == nil {
+		// a vpnc-script may have left a symlink to its own copy
+		if err := os.Remove(resolvConfPath); err != nil {
+			return fmt.Errorf("removing symlink to %s: %w", target, err)
+		}
+	}
+	return os.WriteFile(resolvConfPath, []byte(content), 0644)
+}
+
+// systemd-resolved may still serve answers cached from the VPN's nameservers
+func flushResolvedCaches() {
+	if _, err := exec.LookPath("resolvectl"); err == nil {
+		_ = exec.Command("resolvectl", "flush-caches").Run()
+	}
+}
+
+func restoreRoutes(family string, snapshot []string, vpnHost string) ([]string, error) {
+	current, err := readRoutes(family)
+	if err != nil {
+		return nil, err
+	}
+	var changes []string
+	var errs []error
+	for _, route := range current {
+		if slices.Contains(snapshot, route) || !isHostRoute(route, vpnHost) {
+			continue
+		}
+		if err := ipRoute(family, "del", route); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		changes = append(changes, "removed route "+route)
+	}
+	for _, route := range snapshot {
+		if slices.Contains(current, route) {
+			continue
+		}
+		if err := ipRoute(family, "replace", route); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		changes = append(changes, "restored route "+route)
+	}
+	return changes, errors.Join(errs...)
+}
+
+// routes of the main table as `ip route show` prints them, without state flags and
+// without routes through the tunnel
+func readRoutes(family string) ([]string, error) {
+	out, err := exec.Command("ip", family, "route", "show", "table", "main").Output()
+	if err != nil {
+		return nil, fmt.Errorf("ip %s route show: %w", family, err)
+	}
+	var routes []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := slices.DeleteFunc(strings.Fields(line), func(field string) bool {
+			return slices.Contains(routeStateFlags, field)
+		})
+		if len(fields) == 0 || routeViaTunnel(fields) {
+			continue
+		}
+		routes = append(routes, strings.Join(fields, " "))
+	}
+	return routes, nil
+}
+
+func routeViaTunnel(fields []string) bool {
+	for i, field := range fields[:len(fields)-1] {
+		if field != "dev" {
+			continue
+		}
+		for _, pattern := range tunnelInterfaces {
+			if matched, _ := path.Match(pattern, fields[i+1]); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isHostRoute(route string, host string) bool {
+	if host == "" {
+		return false
+	}
+	destination, _, _ := strings.Cut(route, " ")
+	return destination == host || destination == host+"/32" || destination == host+"/128"
+}
+
+func ipRoute(family string, action string, route string) error {
+	args := append([]string{family, "route", action}, strings.Fields(route)...)
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ip %s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
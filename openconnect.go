@@ -11,6 +11,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -19,7 +20,9 @@ import (
 type OpenConnectProcess struct {
 
 	// connection config
+	profile             string
 	url                 string
+	protocol            string
 	dsid                string
 	shutdownGracePeriod time.Duration
 
@@ -29,11 +32,29 @@ type OpenConnectProcess struct {
 	dryRun    bool
 
 	// process management
-	mu      sync.Mutex
-	env     []string
-	ctx     context.Context
-	cmd     *exec.Cmd
-	running bool
+	mu        sync.Mutex
+	env       []string
+	ctx       context.Context
+	cmd       *exec.Cmd
+	running   bool
+	startedAt time.Time
+	stopping  bool
+	// closed once the process has exited and the network has been checked
+	exited chan struct{}
+
+	// puts DNS and routes back when the vpnc-script didn't, see EnableNetworkRestore
+	network networkGuard
+	// --script command, see EnableVpncScript and EnableProxy
+	script    string
+	scriptTun bool
+	// pre-created tun device, see EnableInterface
+	iface string
+	// network namespace the vpnc-script moves the device into, see EnableNamespace
+	namespace string
+
+	// set when the process exits without being asked to, see takeUnexpectedExit
+	exitedUnexpectedly bool
+	exitConnected      bool
 
 	// connection attempt state
 	attemptState *ConnectionAttemptState
@@ -45,8 +66,9 @@ type OpenConnectProcess struct {
 /*
 ConnectionAttemptStatus:
 A pure data structure containing metadata about a given connection attempt. If the attempt
-was successful it should report the server and client IP address. If not it should report
-any error state, specifically if the DSID cookie was rejected by the server.
+was successful it should report the server and client IP address, and the tun device
+with the configuration the server pushed. If not it should report any error state,
+specifically if the DSID cookie was rejected by the server.
 */
 
 type ConnectionAttemptState struct {
@@ -55,15 +77,27 @@ type ConnectionAttemptState struct {
 	clientAddr   string
 	rejectedDSID string
 	needsRestart bool
+	// when the gateway ends the session, as announced by openconnect
+	sessionExpires time.Time
+	// configuration pushed by the server, printed by openconnect at -v (pulse and nc)
+	clientAddr6   string
+	mtu           int
+	dnsServers    []string
+	searchDomains []string
+	splitIncludes []string
+	// the tun device after connecting, see inspectTunnel
+	link *TunnelLink
 }
 
-func NewOpenConnectProcess(vpnConfig VPNConfig, openConnectConfig OpenConnectConfig, ctx context.Context) *OpenConnectProcess {
+func NewOpenConnectProcess(profile Profile, openConnectConfig OpenConnectConfig, ctx context.Context) *OpenConnectProcess {
 	return &OpenConnectProcess{
 		env:                 os.Environ(),
 		ctx:                 ctx,
-		url:                 vpnConfig.Url,
+		profile:             profile.Name,
+		url:                 profile.Url,
+		protocol:            profile.Protocol,
 		shutdownGracePeriod: time.Duration(openConnectConfig.ShutdownGracePeriodSeconds) * time.Second,
-		extraArgs:           openConnectConfig.ExtraArgs,
+		extraArgs:           profile.ExtraArgs,
 		verbose:             openConnectConfig.Verbose,
 		dryRun:              openConnectConfig.DryRun,
 		attemptState:        &ConnectionAttemptState{},
@@ -71,6 +105,41 @@ func NewOpenConnectProcess(vpnConfig VPNConfig, openConnectConfig OpenConnectCon
 	}
 }
 
+// the network state around a connection, kept locally by a NetworkRestorer or by the
+// privileged helper when openconnect runs unprivileged
+type networkGuard interface {
+	save() error
+	setVpnHost(host string)
+	verify()
+}
+
+// snapshot the network before every start and restore it after every exit
+func (p *OpenConnectProcess) EnableNetworkRestore(network networkGuard) {
+	p.network = network
+}
+
+// attach to an existing tun device instead of creating one, which needs root
+func (p *OpenConnectProcess) EnableInterface(name string) {
+	p.iface = name
+}
+
+// the tun device ends up in the namespace name, which is where it is inspected
+func (p *OpenConnectProcess) EnableNamespace(name string) {
+	p.namespace = name
+}
+
+// have openconnect configure the tunnel by running command instead of the system's
+// vpnc-script
+func (p *OpenConnectProcess) EnableVpncScript(command string) {
+	p.script = command
+}
+
+// hand the tunnel to command, a userspace network stack, instead of a tun device
+func (p *OpenConnectProcess) EnableProxy(command string) {
+	p.script = command
+	p.scriptTun = true
+}
+
 func (p *OpenConnectProcess) parseStdout(in io.ReadCloser) {
 	// continually read from stdin looking looking for updates to push into our ConnectionAttemptState
 	defer in.Close()
@@ -78,7 +147,7 @@ func (p *OpenConnectProcess) parseStdout(in io.ReadCloser) {
 	for sc.Scan() {
 		line := sc.Text()
 		if p.verbose {
-			p.log.Printf(line)
+			p.log.Print(line)
 		}
 		if strings.HasPrefix(line, "Connected to ") {
 			// found ip address of vpn host
@@ -86,14 +155,35 @@ func (p *OpenConnectProcess) parseStdout(in io.ReadCloser) {
 			if len(parts) == 3 {
 				host := strings.Split(parts[2], ":")[0]
 				p.attemptState.hostAddr = host
+				if p.network != nil {
+					p.network.setVpnHost(host)
+				}
 				p.log.Printf("Connected to remote %s", host)
 			}
 		} else if strings.HasPrefix(line, "Configured as ") {
-			// found ip address of client
-			host := strings.Split(line, " ")[2]
+			// found ip address of client, "Configured as 10.0.0.2, with SSL connected ..."
+			host := strings.TrimSuffix(strings.Split(line, " ")[2], ",")
 			p.attemptState.clientAddr = host
 			p.log.Printf("Configured client as %s", host)
-		} else if strings.HasPrefix(line, "Session authentication will expire at ") {
+		} else if addr, ok := strings.CutPrefix(line, "Received internal IPv6 address "); ok {
+			p.attemptState.clientAddr6 = strings.TrimSpace(addr)
+		} else if server, ok := strings.CutPrefix(line, "Received DNS server "); ok {
+			p.attemptState.dnsServers = append(p.attemptState.dnsServers, strings.TrimSpace(server))
+		} else if domain, ok := strings.CutPrefix(line, "Received DNS search domain "); ok {
+			p.attemptState.searchDomains = append(p.attemptState.searchDomains, strings.TrimSpace(domain))
+		} else if route, ok := strings.CutPrefix(line, "Received split include route "); ok {
+			p.attemptState.splitIncludes = append(p.attemptState.splitIncludes, strings.TrimSpace(route))
+		} else if mtu, ok := strings.CutPrefix(line, "Received MTU "); ok {
+			// "Received MTU 1400 from server"
+			value, _, _ := strings.Cut(mtu, " ")
+			if n, err := strconv.Atoi(value); err == nil {
+				p.attemptState.mtu = n
+			}
+		} else if expires, ok := strings.CutPrefix(line, "Session authentication will expire at "); ok {
+			// ctime format in local time
+			if at, err := time.ParseInLocation("Mon Jan _2 15:04:05 2006", strings.TrimSpace(expires), time.Local); err == nil {
+				p.attemptState.sessionExpires = at
+			}
 			if p.attemptState.hostAddr != "" && p.attemptState.clientAddr != "" && p.attemptState.rejectedDSID == "" {
 				p.attemptState.success = true
 				p.log.Printf("Successfully connected to remote %s as %s", p.attemptState.hostAddr, p.attemptState.clientAddr)
@@ -110,17 +200,17 @@ func (p *OpenConnectProcess) parseStderr(r io.ReadCloser) {
 	sc := bufio.NewScanner(r)
 	for sc.Scan() {
 		line := sc.Text()
-		pulsePacketSpam := strings.HasPrefix(line, "Unknown Pulse packet of ");
+		pulsePacketSpam := strings.HasPrefix(line, "Unknown Pulse packet of ")
 		if p.verbose && !pulsePacketSpam {
-			p.log.Printf(line)
+			p.log.Print(line)
 		}
 		if strings.HasPrefix(line, "ESP detected dead peer") {
 			// todo: signal that we need a restart
 			p.attemptState.needsRestart = true
 		} else if strings.HasPrefix(line, "Cookie was rejected by server") {
-				p.attemptState.rejectedDSID = p.dsid
-				// todo: imediately mark cookie as rejected
-				p.log.Printf("DSID cookie rejected by server: %s", p.dsid)
+			p.attemptState.rejectedDSID = p.dsid
+			// todo: imediately mark cookie as rejected
+			p.log.Printf("DSID cookie rejected by server: %s", p.dsid)
 		}
 	}
 	if err := sc.Err(); err != nil {
@@ -128,11 +218,51 @@ func (p *OpenConnectProcess) parseStderr(r io.ReadCloser) {
 	}
 }
 
+// look at the tun device of a connected process once it exists. Nothing to look at in
+// proxy mode or in dry run mode
+func (p *OpenConnectProcess) inspectTunnel() {
+	if !p.running || !p.attemptState.success || p.attemptState.link != nil || p.scriptTun {
+		return
+	}
+	iface := p.iface
+	if iface == "" {
+		var err error
+		if iface, err = tunDeviceOf(p.pid()); err != nil {
+			return
+		}
+	}
+	link, err := inspectTunnelLink(iface, p.namespace)
+	if err != nil {
+		// not configured yet, tried again on the next tick
+		return
+	}
+	p.attemptState.link = link
+	p.log.Printf("tunnel on %s, mtu %d, %d routes", link.Interface, link.MTU, len(link.Routes))
+}
+
 // get the current dsid and whether or not we saw it rejected
 func (p *OpenConnectProcess) getDSIDStatus() (string, bool) {
 	return p.dsid, p.dsid == p.attemptState.rejectedDSID
 }
 
+// whether the process exited on its own since the last call, and whether it had
+// connected successfully before it did
+func (p *OpenConnectProcess) takeUnexpectedExit() (exited bool, connected bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	exited, connected = p.exitedUnexpectedly, p.exitConnected
+	p.exitedUnexpectedly = false
+	return exited, connected
+}
+
+// pid of the running openconnect process, 0 if there is none (or in dry run mode)
+func (p *OpenConnectProcess) pid() int {
+	if p.cmd == nil || p.cmd.Process == nil {
+		return 0
+	}
+	return p.cmd.Process.Pid
+}
+
 func (p *OpenConnectProcess) Start() error {
 
 	if strings.TrimSpace(p.dsid) == "" {
@@ -147,7 +277,16 @@ func (p *OpenConnectProcess) Start() error {
 	}
 
 	name := "openconnect"
-	args := []string{"-C", p.dsid, "--protocol=pulse"}
+	args := []string{"-C", p.dsid, "--protocol=" + p.protocol}
+	if p.script != "" {
+		args = append(args, "--script="+p.script)
+	}
+	if p.scriptTun {
+		args = append(args, "--script-tun")
+	}
+	if p.iface != "" {
+		args = append(args, "--interface="+p.iface)
+	}
 	if p.extraArgs != "" {
 		for _, arg := range strings.Split(p.extraArgs, " ") {
 			args = append(args, arg)
@@ -158,6 +297,7 @@ func (p *OpenConnectProcess) Start() error {
 	if p.dryRun {
 		log.Printf("[dry run] %s %s", name, strings.Join(args, " "))
 		p.running = true
+		p.startedAt = time.Now()
 		return nil
 	}
 
@@ -177,6 +317,12 @@ func (p *OpenConnectProcess) Start() error {
 		return fmt.Errorf("stderr pipe: %w", err)
 	}
 
+	if p.network != nil {
+		if err := p.network.save(); err != nil {
+			p.log.Printf("could not snapshot the network, it won't be restored after exit: %v", err)
+		}
+	}
+
 	// clear state
 	p.attemptState = &ConnectionAttemptState{success: false}
 	go p.parseStdout(stdout)
@@ -190,22 +336,65 @@ func (p *OpenConnectProcess) Start() error {
 
 	p.cmd = cmd
 	p.running = true
+	p.stopping = false
+	p.startedAt = time.Now()
+	exited := make(chan struct{})
+	p.exited = exited
+	attemptState := p.attemptState
 
 	go func() {
 		err := cmd.Wait()
-		p.mu.Lock()
-		p.running = false
-		p.mu.Unlock()
 		if err != nil {
 			p.log.Printf("[child] exited with error: %v", err)
 		} else {
 			p.log.Printf("[child] exited")
 		}
+		// still counts as running until the network is back, so that the next start
+		// doesn't snapshot the broken state
+		if p.network != nil {
+			p.network.verify()
+		}
+		p.mu.Lock()
+		p.running = false
+		p.cmd = nil
+		if !p.stopping {
+			p.exitedUnexpectedly = true
+			p.exitConnected = attemptState.success
+		}
+		p.mu.Unlock()
+		close(exited)
 	}()
 
 	return nil
 }
 
+// apply new settings, returning true when the running process has to be restarted
+// for them to take effect. Logging and shutdown settings apply immediately
+func (p *OpenConnectProcess) reconfigure(profile Profile, openConnectConfig OpenConnectConfig) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	restart := p.url != profile.Url || p.protocol != profile.Protocol || p.extraArgs != profile.ExtraArgs || p.dryRun != openConnectConfig.DryRun
+	p.setProfileLocked(profile)
+	p.dryRun = openConnectConfig.DryRun
+	p.verbose = openConnectConfig.Verbose
+	p.shutdownGracePeriod = time.Duration(openConnectConfig.ShutdownGracePeriodSeconds) * time.Second
+	return restart
+}
+
+// connect to a different profile the next time the process is started
+func (p *OpenConnectProcess) setProfile(profile Profile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.setProfileLocked(profile)
+}
+
+func (p *OpenConnectProcess) setProfileLocked(profile Profile) {
+	p.profile = profile.Name
+	p.url = profile.Url
+	p.protocol = profile.Protocol
+	p.extraArgs = profile.ExtraArgs
+}
+
 func (p *OpenConnectProcess) Restart() {
 	p.Stop()
 	p.Start()
@@ -215,19 +404,25 @@ func (p *OpenConnectProcess) Stop() {
 
 	p.mu.Lock()
 	cmd := p.cmd
+	if cmd == nil || !p.running {
+		// nothing was started, it has exited already, or only in dry run mode
+		p.running = false
+		p.mu.Unlock()
+		return
+	}
+	p.stopping = true
+	waitCh := p.exited
 	p.mu.Unlock()
-	if cmd == nil { //|| !running {
+	pgid, err := syscall.Getpgid(cmd.Process.Pid)
+	if err != nil || pgid <= 1 {
+		// reaped already, only the network is being checked. pgid 0 would signal the
+		// manager's own process group
+		<-waitCh
 		return
 	}
-	pgid, _ := syscall.Getpgid(cmd.Process.Pid)
 
 	// Try graceful first.
 	_ = syscall.Kill(-pgid, syscall.SIGTERM) // negative => process group
-	waitCh := make(chan struct{})
-	go func() {
-		cmd.Wait() // already reaped in Start goroutine, but safe to wait again
-		close(waitCh)
-	}()
 
 	// wait for shutdown or force SIGKILL
 	select {
@@ -238,6 +433,8 @@ func (p *OpenConnectProcess) Stop() {
 		return
 	case <-time.After(p.shutdownGracePeriod):
 		_ = syscall.Kill(-pgid, syscall.SIGKILL)
+		// the vpnc-script got killed too, wait for the network to be restored
+		<-waitCh
 		p.mu.Lock()
 		p.running = false
 		p.attemptState = &ConnectionAttemptState{success: false}
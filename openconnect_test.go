@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testOpenConnectProcess() *OpenConnectProcess {
+	p := NewOpenConnectProcess(Profile{Name: "default", Url: "https://vpn.example.com"}, OpenConnectConfig{}, context.Background())
+	p.log = log.New(io.Discard, "", 0)
+	return p
+}
+
+func TestParseStdout(t *testing.T) {
+	expires := time.Now().Add(12 * time.Hour).Truncate(time.Second)
+	expiresLine := "Session authentication will expire at " + expires.Format("Mon Jan _2 15:04:05 2006")
+	tests := []struct {
+		name     string
+		stdout   []string
+		rejected bool
+		want     ConnectionAttemptState
+	}{
+		{
+			name: "connected",
+			stdout: []string{
+				"Connected to 203.0.113.5:443",
+				"Received internal IPv6 address 2001:db8::1",
+				"Received MTU 1400 from server",
+				"Received DNS server 10.20.0.53",
+				"Received DNS server 10.20.0.54",
+				"Received DNS search domain corp.example.com",
+				"Received split include route 10.0.0.0/255.0.0.0",
+				"Received split include route 172.16.0.0/255.240.0.0",
+				"Configured as 10.20.30.40, with SSL connected and ESP in progress",
+				expiresLine,
+			},
+			want: ConnectionAttemptState{
+				success:        true,
+				hostAddr:       "203.0.113.5",
+				clientAddr:     "10.20.30.40",
+				sessionExpires: expires,
+				clientAddr6:    "2001:db8::1",
+				mtu:            1400,
+				dnsServers:     []string{"10.20.0.53", "10.20.0.54"},
+				searchDomains:  []string{"corp.example.com"},
+				splitIncludes:  []string{"10.0.0.0/255.0.0.0", "172.16.0.0/255.240.0.0"},
+			},
+		},
+		{
+			name:   "not configured yet",
+			stdout: []string{"Connected to 203.0.113.5:443", expiresLine},
+			want:   ConnectionAttemptState{hostAddr: "203.0.113.5", sessionExpires: expires},
+		},
+		{
+			name:     "cookie rejected",
+			stdout:   []string{"Connected to 203.0.113.5:443", "Configured as 10.20.30.40", expiresLine},
+			rejected: true,
+			want:     ConnectionAttemptState{hostAddr: "203.0.113.5", clientAddr: "10.20.30.40", rejectedDSID: "dsid", sessionExpires: expires},
+		},
+		{
+			name: "garbage",
+			stdout: []string{
+				"Connected to somewhere else entirely",
+				"Received MTU lots from server",
+				"Session authentication will expire at soon",
+				"POST https://vpn.example.com/",
+			},
+			want: ConnectionAttemptState{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testOpenConnectProcess()
+			if tt.rejected {
+				p.dsid = "dsid"
+				p.parseStderr(io.NopCloser(strings.NewReader("Cookie was rejected by server; exiting.\n")))
+			}
+			p.parseStdout(io.NopCloser(strings.NewReader(strings.Join(tt.stdout, "\n") + "\n")))
+			got := p.attemptState
+			if got.success != tt.want.success || got.hostAddr != tt.want.hostAddr || got.clientAddr != tt.want.clientAddr || got.rejectedDSID != tt.want.rejectedDSID {
+				t.Errorf("got success=%v host %q client %q rejected %q, want success=%v host %q client %q rejected %q",
+					got.success, got.hostAddr, got.clientAddr, got.rejectedDSID, tt.want.success, tt.want.hostAddr, tt.want.clientAddr, tt.want.rejectedDSID)
+			}
+			if !got.sessionExpires.Equal(tt.want.sessionExpires) {
+				t.Errorf("session expires %v, want %v", got.sessionExpires, tt.want.sessionExpires)
+			}
+			if got.clientAddr6 != tt.want.clientAddr6 || got.mtu != tt.want.mtu {
+				t.Errorf("got ipv6 %q mtu %d, want %q %d", got.clientAddr6, got.mtu, tt.want.clientAddr6, tt.want.mtu)
+			}
+			if !slices.Equal(got.dnsServers, tt.want.dnsServers) || !slices.Equal(got.searchDomains, tt.want.searchDomains) || !slices.Equal(got.splitIncludes, tt.want.splitIncludes) {
+				t.Errorf("got dns %q search %q split %q, want %q %q %q",
+					got.dnsServers, got.searchDomains, got.splitIncludes, tt.want.dnsServers, tt.want.searchDomains, tt.want.splitIncludes)
+			}
+		})
+	}
+}
+
+func TestParseStderr(t *testing.T) {
+	p := testOpenConnectProcess()
+	p.dsid = "dsid"
+	p.parseStderr(io.NopCloser(strings.NewReader("Unknown Pulse packet of 16 bytes\nESP detected dead peer\n")))
+	if !p.attemptState.needsRestart || p.attemptState.rejectedDSID != "" {
+		t.Errorf("got needsRestart=%v rejected %q, want a restart only", p.attemptState.needsRestart, p.attemptState.rejectedDSID)
+	}
+}
@@ -5,7 +5,7 @@ let
     patches = (old.patches or [ ]) ++ [ ./patched/pulse.patch ];
   });
 
-  runtimePaths = [ openconnect-patched ];
+  runtimePaths = [ openconnect-patched pkgs.iproute2 pkgs.ocproxy pkgs.nftables ];
   runtimePathString = lib.makeSearchPath "bin" runtimePaths;
 
   goPkg = pkgs.buildGoModule {
@@ -14,6 +14,7 @@ let
     src = ../.;
     vendorHash = null;
     subPackages = [ "." ];
+    ldflags = [ "-X main.version=0.1.0" ];
   };
 in
 pkgs.stdenv.mkDerivation {
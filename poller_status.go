@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+Poller status:
+What went wrong while reading the DSID, sorted into a few kinds so that the log says
+what to fix. Each kind is logged when it first happens and then at most every
+pollerErrorInterval while it persists. After every read the poller writes its status
+next to the DSID file, where the manager picks it up for `status`.
+*/
+
+type PollerErrorKind string
+
+const (
+	// the cookie database does not exist or cannot be read
+	PollerFileMissing PollerErrorKind = "file_missing"
+	// the cookie database could not be opened, e.g. caught in the middle of a write
+	PollerDBLocked         PollerErrorKind = "db_locked"
+	PollerDecryptionFailed PollerErrorKind = "decryption_failed"
+	PollerCookieNotFound   PollerErrorKind = "cookie_not_found"
+	PollerWriteFailed      PollerErrorKind = "write_failed"
+)
+
+// what the user can do about each kind of error
+var pollerErrorHints = map[PollerErrorKind]string{
+	PollerFileMissing:      "check [dsidCookiePoller].cookiePath or browserProfile and that the poller runs as the browser's user",
+	PollerDBLocked:         "retried on the next change of the database",
+	PollerDecryptionFailed: "unlock the keyring and check that cookiePath belongs to the browser whose key is used",
+	PollerCookieNotFound:   "log in to the VPN portal in the browser",
+	PollerWriteFailed:      "check [dsidStore] and that the DSID file's directory is writable",
+}
+
+const pollerErrorInterval = 10 * time.Minute
+
+type PollerError struct {
+	Kind    PollerErrorKind `json:"kind"`
+	Message string          `json:"message"`
+}
+
+func (e *PollerError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Message)
+}
+
+func newPollerError(kind PollerErrorKind, format string, args ...any) *PollerError {
+	return &PollerError{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+// sort an error from copying or reading the cookie database
+func classifyCookieError(err error) *PollerError {
+	switch {
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, os.ErrPermission):
+		return &PollerError{Kind: PollerFileMissing, Message: err.Error()}
+	case strings.Contains(err.Error(), "decrypting cookie"):
+		// also covers a locked or missing keyring, the key is looked up on first use
+		return &PollerError{Kind: PollerDecryptionFailed, Message: err.Error()}
+	default:
+		return &PollerError{Kind: PollerDBLocked, Message: err.Error()}
+	}
+}
+
+type reportedError struct {
+	at         time.Time
+	suppressed int
+}
+
+// logs errors by key, each at most once per interval while it keeps happening
+type pollerErrorLog struct {
+	interval time.Duration
+	reported map[string]*reportedError
+	log      *log.Logger
+}
+
+func newPollerErrorLog(interval time.Duration, logger *log.Logger) *pollerErrorLog {
+	return &pollerErrorLog{interval: interval, reported: make(map[string]*reportedError), log: logger}
+}
+
+func (l *pollerErrorLog) report(key string, err *PollerError) {
+	now := time.Now()
+	r, ok := l.reported[key]
+	if ok && now.Sub(r.at) < l.interval {
+		r.suppressed++
+		return
+	}
+	if ok && r.suppressed > 0 {
+		l.log.Printf("%s: %v (%d more since %s)", key, err, r.suppressed, r.at.Format(time.TimeOnly))
+	} else {
+		l.log.Printf("%s: %v", key, err)
+	}
+	l.reported[key] = &reportedError{at: now}
+}
+
+func (l *pollerErrorLog) clear(key string) {
+	if _, ok := l.reported[key]; ok {
+		l.log.Printf("%s: resolved", key)
+		delete(l.reported, key)
+	}
+}
+
+type PollerProfileStatus struct {
+	Profile string `json:"profile"`
+	Domain  string `json:"domain"`
+	Found   bool   `json:"found"`
+	// browser profile the DSID was found in
+	Source string       `json:"source,omitempty"`
+	Error  *PollerError `json:"error,omitempty"`
+}
+
+type PollerStatus struct {
+	At      time.Time `json:"at"`
+	Healthy bool      `json:"healthy"`
+	// last read without errors, zero if there was none since the poller started
+	LastSuccessAt time.Time `json:"lastSuccessAt,omitempty"`
+	// reading the database failed, no profile was looked at
+	Error    *PollerError          `json:"error,omitempty"`
+	Profiles []PollerProfileStatus `json:"profiles"`
+}
+
+func pollerStatusPath(dsidPath string) string {
+	return dsidPath + ".poller"
+}
+
+func writePollerStatus(dsidPath string, status PollerStatus) error {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	// readable by the manager, which may run as root or as another user
+	return writeFileAtomic(pollerStatusPath(dsidPath), data, 0644)
+}
+
+func readPollerStatus(dsidPath string) (*PollerStatus, error) {
+	data, err := os.ReadFile(pollerStatusPath(dsidPath))
+	if err != nil {
+		return nil, err
+	}
+	var status PollerStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// one line summary for `status`
+func (s *PollerStatus) summary() string {
+	age := time.Since(s.At).Round(time.Second)
+	if s.Healthy {
+		return fmt.Sprintf("ok, read %s ago", age)
+	}
+	if s.Error != nil {
+		return fmt.Sprintf("%s, read %s ago", s.Error.Kind, age)
+	}
+	for _, p := range s.Profiles {
+		if p.Error != nil && p.Error.Kind != PollerCookieNotFound {
+			return fmt.Sprintf("%s for profile %s, read %s ago", p.Error.Kind, p.Profile, age)
+		}
+	}
+	return fmt.Sprintf("unhealthy, read %s ago", age)
+}
+
+// what one read of a cookie database found, for `poll -explain`
+type sourceResult struct {
+	source string
+	path   string
+	err    *PollerError
+	// domains a cookie named cookieName was found for
+	domains        []string
+	decryptErrors  int
+	decryptExample string
+}
+
+// what one read of the cookie databases found
+type pollResult struct {
+	cookieName  string
+	sources     []sourceResult
+	status      PollerStatus
+	written     map[string]bool
+	maskedDSIDs map[string]string
+}
+
+func (r *pollResult) decryptErrors() int {
+	total := 0
+	for _, source := range r.sources {
+		total += source.decryptErrors
+	}
+	return total
+}
+
+func printPollResult(w io.Writer, r pollResult) {
+	for _, source := range r.sources {
+		fmt.Fprintf(w, "browser profile  %s\n", source.source)
+		fmt.Fprintf(w, "cookie database  %s\n", source.path)
+		if source.err != nil {
+			fmt.Fprintf(w, "read             failed, %v\n", source.err)
+			fmt.Fprintf(w, "                 %s\n\n", pollerErrorHints[source.err.Kind])
+			continue
+		}
+		fmt.Fprintf(w, "read             ok\n")
+		fmt.Fprintf(w, "%-16s %d found", r.cookieName+" cookies", len(source.domains))
+		if len(source.domains) > 0 {
+			fmt.Fprintf(w, ", for %s", strings.Join(source.domains, ", "))
+		}
+		fmt.Fprintln(w)
+		if source.decryptErrors > 0 {
+			fmt.Fprintf(w, "not decrypted    %d, e.g. %s\n", source.decryptErrors, source.decryptExample)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, p := range r.status.Profiles {
+		fmt.Fprintf(w, "profile %s (cookie host %s)\n", p.Profile, p.Domain)
+		switch {
+		case p.Error != nil:
+			fmt.Fprintf(w, "  %v\n  %s\n", p.Error, pollerErrorHints[p.Error.Kind])
+		case r.written[p.Profile]:
+			fmt.Fprintf(w, "  dsid %s from %s, published\n", r.maskedDSIDs[p.Profile], p.Source)
+		default:
+			fmt.Fprintf(w, "  dsid %s from %s, unchanged\n", r.maskedDSIDs[p.Profile], p.Source)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+/*
+PreflightChecker:
+Checks that a gateway can be reached before openconnect is started: the gateway host
+resolves, accepts a TCP connection and completes a TLS handshake. When that fails, a
+well-known connectivity URL is probed to tell a captive portal apart from having no
+network at all.
+*/
+
+type PreflightChecker struct {
+	timeout          time.Duration
+	captivePortalUrl string
+	verifyTLS        bool
+}
+
+type PreflightResult struct {
+	Ok bool
+	// dns, tcp, tls or captive-portal
+	Stage string
+	Err   error
+}
+
+func (r PreflightResult) String() string {
+	if r.Ok {
+		return "gateway reachable"
+	}
+	return fmt.Sprintf("%s: %v", r.Stage, r.Err)
+}
+
+func NewPreflightChecker(config PreflightConfig) *PreflightChecker {
+	return &PreflightChecker{
+		timeout:          time.Duration(config.TimeoutSeconds) * time.Second,
+		captivePortalUrl: config.CaptivePortalUrl,
+		verifyTLS:        config.VerifyTLS,
+	}
+}
+
+func (p *PreflightChecker) check(gateway string) PreflightResult {
+	u, err := url.Parse(gateway)
+	if err != nil {
+		return PreflightResult{Stage: "dns", Err: err}
+	}
+	address, err := gatewayAddress(gateway)
+	if err != nil {
+		return PreflightResult{Stage: "dns", Err: err}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	host := u.Hostname()
+	if net.ParseIP(host) == nil {
+		if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+			return PreflightResult{Stage: "dns", Err: err}
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: p.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return p.classify(PreflightResult{Stage: "tcp", Err: err})
+	}
+	defer conn.Close()
+
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: !p.verifyTLS})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return p.classify(PreflightResult{Stage: "tls", Err: err})
+		}
+	}
+	return PreflightResult{Ok: true}
+}
+
+// a failed connection to the gateway is reported as a captive portal when the
+// connectivity check URL is being intercepted
+func (p *PreflightChecker) classify(result PreflightResult) PreflightResult {
+	if p.captivePortalUrl == "" {
+		return result
+	}
+	if portal, err := p.captivePortal(); err == nil && portal != "" {
+		return PreflightResult{Stage: "captive-portal", Err: fmt.Errorf("login required at %s (%s failed: %v)", portal, result.Stage, result.Err)}
+	}
+	return result
+}
+
+// returns the portal location when the connectivity check doesn't get the expected
+// empty 204 response
+func (p *PreflightChecker) captivePortal() (string, error) {
+	client := &http.Client{
+		Timeout: p.timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(p.captivePortalUrl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return "", nil
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		if location := resp.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+		return p.captivePortalUrl, nil
+	case resp.StatusCode == http.StatusOK:
+		return p.captivePortalUrl, nil
+	default:
+		return "", errors.New(resp.Status)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"sort"
+)
+
+/*
+Profiles:
+A profile is one VPN endpoint the manager can connect to. [vpn].url, when set, is the
+profile named "default"; additional [profiles.<name>] sections add more. Unset profile
+fields inherit from [vpn], [dsidCookiePoller] and [openconnect]. Each profile gets its
+own DSID file so the poller can track cookies for all of them at once.
+*/
+
+const defaultProfileName = "default"
+
+var openConnectProtocols = []string{"anyconnect", "array", "f5", "fortinet", "gp", "nc", "pulse"}
+
+type ProfileConfig struct {
+	Url                string   `toml:"url"`
+	CookieHost         string   `toml:"cookieHost"`
+	Protocol           string   `toml:"protocol"`
+	ExtraArgs          string   `toml:"extraArgs"`
+	Gateways           []string `toml:"gateways"`
+	GatewayPolicy      string   `toml:"gatewayPolicy"`
+	GatewayMaxFailures int      `toml:"gatewayMaxFailures"`
+}
+
+// effective settings of a profile after inheritance
+type Profile struct {
+	Name       string `json:"name"`
+	Url        string `json:"url"`
+	CookieHost string `json:"cookieHost"`
+	Protocol   string `json:"protocol"`
+	ExtraArgs  string `json:"extraArgs,omitempty"`
+	// url followed by the alternative gateways
+	Gateways           []string `json:"gateways"`
+	GatewayPolicy      string   `json:"gatewayPolicy"`
+	GatewayMaxFailures int      `json:"gatewayMaxFailures"`
+}
+
+// all profiles sorted by name
+func (c Config) ResolveProfiles() []Profile {
+	var profiles []Profile
+	if c.Vpn.Url != "" {
+		profiles = append(profiles, Profile{
+			Name:               defaultProfileName,
+			Url:                c.Vpn.Url,
+			CookieHost:         c.DsidCookiePoller.CookieHost,
+			Protocol:           c.Vpn.Protocol,
+			ExtraArgs:          c.OpenConnect.ExtraArgs,
+			Gateways:           gatewayList(c.Vpn.Url, c.Vpn.Gateways),
+			GatewayPolicy:      c.Vpn.GatewayPolicy,
+			GatewayMaxFailures: c.Vpn.GatewayMaxFailures,
+		})
+	}
+	for name, pc := range c.Profiles {
+		profile := Profile{
+			Name:               name,
+			Url:                pc.Url,
+			CookieHost:         pc.CookieHost,
+			Protocol:           pc.Protocol,
+			ExtraArgs:          pc.ExtraArgs,
+			Gateways:           gatewayList(pc.Url, pc.Gateways),
+			GatewayPolicy:      pc.GatewayPolicy,
+			GatewayMaxFailures: pc.GatewayMaxFailures,
+		}
+		if profile.CookieHost == "" {
+			if u, err := url.Parse(pc.Url); err == nil {
+				profile.CookieHost = u.Hostname()
+			}
+		}
+		if profile.Protocol == "" {
+			profile.Protocol = c.Vpn.Protocol
+		}
+		if profile.ExtraArgs == "" {
+			profile.ExtraArgs = c.OpenConnect.ExtraArgs
+		}
+		if profile.GatewayPolicy == "" {
+			profile.GatewayPolicy = c.Vpn.GatewayPolicy
+		}
+		if profile.GatewayMaxFailures == 0 {
+			profile.GatewayMaxFailures = c.Vpn.GatewayMaxFailures
+		}
+		profiles = append(profiles, profile)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
+
+// the primary url followed by any alternative gateways, without duplicates
+func gatewayList(primary string, alternatives []string) []string {
+	gateways := []string{primary}
+	for _, gateway := range alternatives {
+		if !slices.Contains(gateways, gateway) {
+			gateways = append(gateways, gateway)
+		}
+	}
+	return gateways
+}
+
+func (c Config) Profile(name string) (Profile, bool) {
+	for _, profile := range c.ResolveProfiles() {
+		if profile.Name == name {
+			return profile, true
+		}
+	}
+	return Profile{}, false
+}
+
+// the profile the manager connects to on startup: [vpn].profile, the default
+// profile, or the only profile there is
+func (c Config) ActiveProfileName() string {
+	if c.Vpn.Profile != "" {
+		return c.Vpn.Profile
+	}
+	profiles := c.ResolveProfiles()
+	if len(profiles) == 1 {
+		return profiles[0].Name
+	}
+	return defaultProfileName
+}
+
+func (c Config) validateProfiles() []ConfigError {
+	var problems []ConfigError
+	add := func(key string, format string, args ...any) {
+		problems = append(problems, ConfigError{Key: key, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Vpn.Url == "" && len(c.Profiles) == 0 {
+		add("vpn.url", "is required unless [profiles.<name>] sections are defined")
+	}
+	if c.Vpn.Url != "" {
+		if problem := checkVpnUrl(c.Vpn.Url); problem != "" {
+			add("vpn.url", "%s", problem)
+		}
+	}
+	if !slices.Contains(openConnectProtocols, c.Vpn.Protocol) {
+		add("vpn.protocol", "must be one of %v, got %q", openConnectProtocols, c.Vpn.Protocol)
+	}
+	problems = append(problems, validateGateways("vpn", c.Vpn.Gateways, c.Vpn.GatewayPolicy, c.Vpn.GatewayMaxFailures, true)...)
+	for _, name := range slices.Sorted(maps.Keys(c.Profiles)) {
+		pc := c.Profiles[name]
+		prefix := "profiles." + name
+		if name == defaultProfileName && c.Vpn.Url != "" {
+			add(prefix, "conflicts with the default profile defined by vpn.url")
+		}
+		if pc.Url == "" {
+			add(prefix+".url", "is required")
+		} else if problem := checkVpnUrl(pc.Url); problem != "" {
+			add(prefix+".url", "%s", problem)
+		}
+		if pc.Protocol != "" && !slices.Contains(openConnectProtocols, pc.Protocol) {
+			add(prefix+".protocol", "must be one of %v, got %q", openConnectProtocols, pc.Protocol)
+		}
+		problems = append(problems, validateGateways(prefix, pc.Gateways, pc.GatewayPolicy, pc.GatewayMaxFailures, false)...)
+	}
+
+	if _, found := c.Profile(c.ActiveProfileName()); !found && (c.Vpn.Url != "" || len(c.Profiles) > 0) {
+		if c.Vpn.Profile == "" {
+			add("vpn.profile", "is required to choose between several profiles")
+		} else {
+			add("vpn.profile", "no profile named %q", c.Vpn.Profile)
+		}
+	}
+	return problems
+}
+
+// required is false for profiles, where an unset policy is inherited from [vpn]
+func validateGateways(section string, gateways []string, policy string, maxFailures int, required bool) []ConfigError {
+	var problems []ConfigError
+	for _, gateway := range gateways {
+		if problem := checkVpnUrl(gateway); problem != "" {
+			problems = append(problems, ConfigError{Key: section + ".gateways", Message: problem})
+		}
+	}
+	if (required || policy != "") && !slices.Contains(gatewayPolicies, policy) {
+		problems = append(problems, ConfigError{Key: section + ".gatewayPolicy", Message: fmt.Sprintf("must be one of %v, got %q", gatewayPolicies, policy)})
+	}
+	if maxFailures < 0 || (required && maxFailures == 0) {
+		problems = append(problems, ConfigError{Key: section + ".gatewayMaxFailures", Message: fmt.Sprintf("must be greater than 0, got %d", maxFailures)})
+	}
+	return problems
+}
+
+func checkVpnUrl(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err.Error()
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Sprintf("must be an http(s) URL with a host, got %q", raw)
+	}
+	return ""
+}
+
+// the DSID file for a profile, the default profile keeps the configured path
+func profileDSIDPath(dsidPath string, profile string) string {
+	if profile == defaultProfileName {
+		return dsidPath
+	}
+	return dsidPath + "." + profile
+}
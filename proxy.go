@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+/*
+Proxy mode:
+openconnect runs with --script-tun, handing the tunnel to ocproxy or tunsocks on a pipe
+instead of creating a tun device. They run a userspace TCP/IP stack and offer a local
+SOCKS5 proxy (and with tunsocks an HTTP proxy) into the VPN. Nothing on the host is
+reconfigured, so neither openconnect nor the manager need root.
+*/
+
+// the --script command openconnect runs with --script-tun
+func proxyCommand(config ProxyConfig) string {
+	command := fmt.Sprintf("%s -D %d", shellQuote(config.Program), config.SocksPort)
+	if config.HttpPort != 0 {
+		command += fmt.Sprintf(" -H %d", config.HttpPort)
+	}
+	return command
+}
+
+func proxyAddress(config ProxyConfig) string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(config.SocksPort))
+}
+
+// connect to address through the SOCKS5 proxy at proxy. The host name is passed to the
+// proxy unresolved so that it is looked up with the VPN's nameservers
+func dialSocks5(proxy string, address string, timeout time.Duration) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portString)
+	}
+	if len(host) > 255 {
+		return nil, fmt.Errorf("host name %q is too long", host)
+	}
+	conn, err := net.DialTimeout("tcp", proxy, timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	// version 5, one method: no authentication
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply[0] != 5 || reply[1] != 0 {
+		conn.Close()
+		return nil, errors.New("socks proxy requires authentication")
+	}
+
+	request := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		request = append(request, 3, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(append(request, 1), ip4...)
+	} else {
+		request = append(append(request, 4), ip.To16()...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if header[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("socks proxy could not connect to %s (reply %d)", address, header[1])
+	}
+	// skip the bound address
+	var skip int
+	switch header[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		skip = int(length[0])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/godbus/dbus/v5"
+)
+
+/*
+resolvedLink:
+Per-link DNS configuration through systemd-resolved's D-Bus API, the same calls
+resolvectl makes. Settings disappear with the link, RevertLink only matters when the
+tunnel device outlives the connection.
+*/
+
+const (
+	resolvedService   = "org.freedesktop.resolve1"
+	resolvedPath      = "/org/freedesktop/resolve1"
+	resolvedInterface = "org.freedesktop.resolve1.Manager"
+)
+
+type resolvedDNS struct {
+	Family  int32
+	Address []byte
+}
+
+type resolvedDomain struct {
+	Domain string
+	// only route queries for the domain to the link, don't use it as a search domain
+	RoutingOnly bool
+}
+
+type resolvedLink struct {
+	conn  *dbus.Conn
+	index int32
+}
+
+func openResolvedLink(index int) (*resolvedLink, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return &resolvedLink{conn: conn, index: int32(index)}, nil
+}
+
+func (l *resolvedLink) Close() {
+	l.conn.Close()
+}
+
+func (l *resolvedLink) call(method string, args ...any) error {
+	args = append([]any{l.index}, args...)
+	return l.conn.Object(resolvedService, resolvedPath).Call(resolvedInterface+"."+method, 0, args...).Err
+}
+
+func (l *resolvedLink) setDNS(servers []net.IP) error {
+	var dns []resolvedDNS
+	for _, server := range servers {
+		if ip4 := server.To4(); ip4 != nil {
+			dns = append(dns, resolvedDNS{Family: syscall.AF_INET, Address: ip4})
+		} else {
+			dns = append(dns, resolvedDNS{Family: syscall.AF_INET6, Address: server.To16()})
+		}
+	}
+	return l.call("SetLinkDNS", dns)
+}
+
+func (l *resolvedLink) setDomains(domains []resolvedDomain) error {
+	return l.call("SetLinkDomains", domains)
+}
+
+// whether queries for domains no link claims are sent to this link
+func (l *resolvedLink) setDefaultRoute(enabled bool) error {
+	return l.call("SetLinkDefaultRoute", enabled)
+}
+
+func (l *resolvedLink) revert() error {
+	return l.call("RevertLink")
+}
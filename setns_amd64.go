@@ -0,0 +1,4 @@
+package main
+
+// from asm/unistd_64.h, not exported by syscall
+const sysSetns = 308
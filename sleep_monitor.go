@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+
+	"github.com/godbus/dbus/v5"
+)
+
+/*
+SleepMonitor:
+Listens for logind's PrepareForSleep signal on the system bus. While running it holds
+a "delay" sleep inhibitor lock, so that on suspend the controller gets a chance to stop
+openconnect cleanly before the lock is released and the machine goes to sleep. The bus
+address can be pointed at a stand-in service for testing.
+*/
+
+const (
+	logindService   = "org.freedesktop.login1"
+	logindPath      = "/org/freedesktop/login1"
+	logindInterface = "org.freedesktop.login1.Manager"
+)
+
+type SleepMonitor struct {
+	busAddress string
+	conn       *dbus.Conn
+	inhibitFd  int
+	// true when about to sleep, false after resuming
+	events chan bool
+	log    *log.Logger
+}
+
+func NewSleepMonitor(config SleepConfig) *SleepMonitor {
+	return &SleepMonitor{
+		busAddress: config.BusAddress,
+		inhibitFd:  -1,
+		events:     make(chan bool, 4),
+		log:        log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile),
+	}
+}
+
+func (m *SleepMonitor) Events() <-chan bool {
+	return m.events
+}
+
+func (m *SleepMonitor) Start() error {
+	var err error
+	if m.busAddress == "" {
+		m.conn, err = dbus.ConnectSystemBus()
+	} else {
+		m.conn, err = dbus.Connect(m.busAddress)
+	}
+	if err != nil {
+		return fmt.Errorf("connecting to D-Bus: %w", err)
+	}
+
+	err = m.conn.AddMatchSignal(
+		dbus.WithMatchSender(logindService),
+		dbus.WithMatchObjectPath(logindPath),
+		dbus.WithMatchInterface(logindInterface),
+		dbus.WithMatchMember("PrepareForSleep"),
+	)
+	if err != nil {
+		m.conn.Close()
+		return fmt.Errorf("subscribing to PrepareForSleep: %w", err)
+	}
+
+	m.inhibit()
+	signals := make(chan *dbus.Signal, 4)
+	m.conn.Signal(signals)
+	go func() {
+		for signal := range signals {
+			if signal.Name != logindInterface+".PrepareForSleep" || len(signal.Body) != 1 {
+				continue
+			}
+			if sleeping, ok := signal.Body[0].(bool); ok {
+				m.events <- sleeping
+			}
+		}
+	}()
+	return nil
+}
+
+// take a delay lock so that suspend waits for us, up to logind's InhibitDelayMaxSec
+func (m *SleepMonitor) inhibit() {
+	if m.inhibitFd >= 0 {
+		return
+	}
+	var fd dbus.UnixFD
+	call := m.conn.Object(logindService, logindPath).Call(logindInterface+".Inhibit", 0,
+		"sleep", programName, "stop openconnect before sleeping", "delay")
+	if err := call.Store(&fd); err != nil {
+		m.log.Printf("could not take a sleep inhibitor lock, openconnect may not be stopped before suspend: %v", err)
+		return
+	}
+	m.inhibitFd = int(fd)
+}
+
+// let the pending suspend proceed
+func (m *SleepMonitor) release() {
+	if m.inhibitFd < 0 {
+		return
+	}
+	_ = syscall.Close(m.inhibitFd)
+	m.inhibitFd = -1
+}
+
+func (m *SleepMonitor) Close() {
+	m.release()
+	if m.conn != nil {
+		m.conn.Close()
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// a private bus with the session bus policy, stopped at the end of the test
+func startTestBus(t *testing.T) string {
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon not available")
+	}
+	cmd := exec.Command("dbus-daemon", "--session", "--address=unix:path="+filepath.Join(t.TempDir(), "bus"), "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("starting dbus-daemon: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading bus address: %v", err)
+	}
+	return strings.TrimSpace(address)
+}
+
+// the write end of a pipe is handed out as the lock, the read end sees EOF once every
+// copy of it is closed
+type inhibitLock struct {
+	r *os.File
+	w *os.File
+}
+
+// stands in for logind
+type fakeLogind struct {
+	locks chan inhibitLock
+}
+
+func (l *fakeLogind) Inhibit(what, who, why, mode string) (dbus.UnixFD, *dbus.Error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return -1, dbus.MakeFailedError(err)
+	}
+	// take the fd before the test can get hold of w and close it
+	fd := w.Fd()
+	l.locks <- inhibitLock{r: r, w: w}
+	return dbus.UnixFD(fd), nil
+}
+
+// the lock handed out by the last Inhibit call, once the caller has it
+func takeLock(t *testing.T, logind *fakeLogind) inhibitLock {
+	t.Helper()
+	select {
+	case lock := <-logind.locks:
+		// the reply has been received, only the caller's copy is left
+		lock.w.Close()
+		t.Cleanup(func() { lock.r.Close() })
+		return lock
+	case <-time.After(5 * time.Second):
+		t.Fatal("no inhibitor lock taken")
+		return inhibitLock{}
+	}
+}
+
+func waitReleased(t *testing.T, lock inhibitLock) {
+	t.Helper()
+	released := make(chan error, 1)
+	go func() {
+		_, err := lock.r.Read(make([]byte, 1))
+		released <- err
+	}()
+	select {
+	case err := <-released:
+		if err == nil {
+			t.Fatal("read data from the inhibitor lock instead of EOF")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("inhibitor lock was not released")
+	}
+}
+
+func waitEvent(t *testing.T, monitor *SleepMonitor, want bool) {
+	t.Helper()
+	select {
+	case sleeping := <-monitor.Events():
+		if sleeping != want {
+			t.Fatalf("got sleep event %v, want %v", sleeping, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no sleep event %v", want)
+	}
+}
+
+func TestSleepMonitor(t *testing.T) {
+	address := startTestBus(t)
+
+	logindConn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logindConn.Close()
+	logind := &fakeLogind{locks: make(chan inhibitLock, 4)}
+	if err := logindConn.Export(logind, logindPath, logindInterface); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := logindConn.RequestName(logindService, dbus.NameFlagDoNotQueue); err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("taking %s: %v %v", logindService, reply, err)
+	}
+
+	monitor := NewSleepMonitor(SleepConfig{Enabled: true, BusAddress: address})
+	if err := monitor.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer monitor.Close()
+	if monitor.inhibitFd < 0 {
+		t.Fatal("no inhibitor lock taken at start")
+	}
+	lock := takeLock(t, logind)
+
+	// suspend: the controller stops openconnect, then lets the suspend proceed
+	if err := logindConn.Emit(logindPath, logindInterface+".PrepareForSleep", true); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, monitor, true)
+	monitor.release()
+	if monitor.inhibitFd >= 0 {
+		t.Fatal("inhibitor fd kept after release")
+	}
+	waitReleased(t, lock)
+
+	// resume: a new lock for the next suspend
+	if err := logindConn.Emit(logindPath, logindInterface+".PrepareForSleep", false); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, monitor, false)
+	monitor.inhibit()
+	lock = takeLock(t, logind)
+	monitor.Close()
+	waitReleased(t, lock)
+}
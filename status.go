@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+type ControllerState string
+
+const (
+	StateWaitingForDSID ControllerState = "waiting_for_dsid"
+	StateNoNetwork      ControllerState = "no_upstream_network"
+	StateConnecting     ControllerState = "connecting"
+	StateConnected      ControllerState = "connected"
+	StateStopped        ControllerState = "stopped"
+	StateSuspended      ControllerState = "suspended"
+)
+
+// snapshot of the manager reported over the control socket
+type StatusReport struct {
+	State              ControllerState `json:"state"`
+	Profile            string          `json:"profile"`
+	Url                string          `json:"url"`
+	Gateways           []string        `json:"gateways"`
+	GatewayPolicy      string          `json:"gatewayPolicy"`
+	Running            bool            `json:"running"`
+	Pid                int             `json:"pid,omitempty"`
+	DryRun             bool            `json:"dryRun"`
+	DSID               string          `json:"dsid,omitempty"`
+	DSIDSince          time.Time       `json:"dsidSince,omitempty"`
+	HostAddr           string          `json:"hostAddr,omitempty"`
+	ClientAddr         string          `json:"clientAddr,omitempty"`
+	StartedAt          time.Time       `json:"startedAt,omitempty"`
+	LastHealthyAt      time.Time       `json:"lastHealthyAt"`
+	RejectedDSIDs      int             `json:"rejectedDsids"`
+	HealthCheckAddress string          `json:"healthCheckAddress"`
+	// why the gateway is considered unreachable, empty when it is reachable
+	Upstream string `json:"upstream,omitempty"`
+	// last status written by the poller, if it runs
+	Poller *PollerStatus `json:"poller,omitempty"`
+	// tun device
+	Interface   string `json:"interface,omitempty"`
+	ClientAddr6 string `json:"clientAddr6,omitempty"`
+	MTU         int    `json:"mtu,omitempty"`
+	// pushed by the server, only known when openconnect runs with -v
+	DNSServers    []string `json:"dnsServers,omitempty"`
+	SearchDomains []string `json:"searchDomains,omitempty"`
+	SplitIncludes []string `json:"splitIncludes,omitempty"`
+	// routes through the tun device
+	Routes []string `json:"routes,omitempty"`
+	// end of the session announced by openconnect
+	SessionExpiresAt time.Time      `json:"sessionExpiresAt,omitempty"`
+	HealthChecks     []HealthSample `json:"healthChecks,omitempty"`
+	// counters of the tun device, when they are watched
+	Tunnel *TunnelStatus `json:"tunnel,omitempty"`
+}
+
+// health checks kept for the status
+const healthSampleCount = 60
+
+type HealthSample struct {
+	At      time.Time     `json:"at"`
+	Ok      bool          `json:"ok"`
+	Latency time.Duration `json:"latency"`
+}
+
+// never print a full cookie, a prefix is enough to tell two apart
+func maskDSID(dsid string) string {
+	if dsid == "" {
+		return ""
+	}
+	if len(dsid) <= 6 {
+		return "***"
+	}
+	return dsid[:6] + "..."
+}
+
+func printStatus(w io.Writer, s StatusReport) {
+	fmt.Fprintf(w, "state          %s\n", s.State)
+	if s.Upstream != "" {
+		fmt.Fprintf(w, "upstream       %s\n", s.Upstream)
+	}
+	fmt.Fprintf(w, "profile        %s\n", s.Profile)
+	fmt.Fprintf(w, "url            %s\n", s.Url)
+	if len(s.Gateways) > 1 {
+		fmt.Fprintf(w, "gateways       %d, policy %s\n", len(s.Gateways), s.GatewayPolicy)
+	}
+	if s.Running && s.Pid > 0 {
+		fmt.Fprintf(w, "openconnect    running (pid %d)\n", s.Pid)
+	} else if s.Running {
+		fmt.Fprintf(w, "openconnect    running\n")
+	} else {
+		fmt.Fprintf(w, "openconnect    not running\n")
+	}
+	if s.DryRun {
+		fmt.Fprintf(w, "dry run        yes\n")
+	}
+	fmt.Fprintf(w, "dsid           %s\n", orNone(s.DSID))
+	fmt.Fprintf(w, "gateway        %s\n", orNone(s.HostAddr))
+	fmt.Fprintf(w, "client ip      %s\n", orNone(s.ClientAddr))
+	if s.ClientAddr6 != "" {
+		fmt.Fprintf(w, "client ipv6    %s\n", s.ClientAddr6)
+	}
+	if s.Interface != "" {
+		if s.MTU > 0 {
+			fmt.Fprintf(w, "interface      %s, mtu %d\n", s.Interface, s.MTU)
+		} else {
+			fmt.Fprintf(w, "interface      %s\n", s.Interface)
+		}
+	}
+	if len(s.DNSServers) > 0 {
+		fmt.Fprintf(w, "dns            %s\n", strings.Join(s.DNSServers, ", "))
+	}
+	if len(s.SearchDomains) > 0 {
+		fmt.Fprintf(w, "search         %s\n", strings.Join(s.SearchDomains, ", "))
+	}
+	printList(w, "split include", s.SplitIncludes)
+	printList(w, "routes", s.Routes)
+	if !s.SessionExpiresAt.IsZero() {
+		fmt.Fprintf(w, "session ends   %s (in %s)\n", s.SessionExpiresAt.Format(time.RFC3339), time.Until(s.SessionExpiresAt).Round(time.Second))
+	}
+	if !s.StartedAt.IsZero() {
+		fmt.Fprintf(w, "started        %s (%s ago)\n", s.StartedAt.Format(time.RFC3339), time.Since(s.StartedAt).Round(time.Second))
+	}
+	fmt.Fprintf(w, "last healthy   %s (%s ago) via %s\n", s.LastHealthyAt.Format(time.RFC3339), time.Since(s.LastHealthyAt).Round(time.Second), s.HealthCheckAddress)
+	fmt.Fprintf(w, "rejected dsids %d\n", s.RejectedDSIDs)
+	if t := s.Tunnel; t != nil {
+		stalled := ""
+		if t.Stalled {
+			stalled = ", stalled"
+		}
+		fmt.Fprintf(w, "tunnel         %s rx %s (%d errors) tx %s (%d errors), received %s ago%s\n", t.Interface,
+			humanBytes(float64(t.Stats.RxBytes)), t.Stats.RxErrors, humanBytes(float64(t.Stats.TxBytes)), t.Stats.TxErrors, time.Since(t.LastRxAt).Round(time.Second), stalled)
+	}
+	if s.Poller != nil {
+		fmt.Fprintf(w, "poller         %s\n", s.Poller.summary())
+	} else {
+		fmt.Fprintf(w, "poller         no status\n")
+	}
+}
+
+// one item per line, the first next to label
+func printList(w io.Writer, label string, items []string) {
+	for i, item := range items {
+		if i == 0 {
+			fmt.Fprintf(w, "%-14s %s\n", label, item)
+		} else {
+			fmt.Fprintf(w, "%-14s %s\n", "", item)
+		}
+	}
+}
+
+type ProfileStatus struct {
+	Profile
+	Active bool   `json:"active"`
+	DSID   string `json:"dsid,omitempty"`
+}
+
+func printProfiles(w io.Writer, profiles []ProfileStatus) {
+	for _, p := range profiles {
+		marker := " "
+		if p.Active {
+			marker = "*"
+		}
+		fmt.Fprintf(w, "%s %-12s %-8s %-40s dsid %s\n", marker, p.Name, p.Protocol, p.Url, orNone(p.DSID))
+	}
+}
+
+func printHistory(w io.Writer, events []Event) {
+	for _, e := range events {
+		fmt.Fprintf(w, "%s  %-10s %s\n", e.Time.Format("2006-01-02 15:04:05"), e.Kind, e.Message)
+	}
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+/*
+Persistent tun device:
+Created by root with an owner, after which that user can attach to it without any
+privileges, which is what `openconnect --interface` does. The device stays until it is
+removed, so it survives openconnect restarts.
+*/
+
+// from linux/if_tun.h, not exported by syscall
+const (
+	tunSetIff     = 0x400454ca
+	tunSetPersist = 0x400454cb
+	tunSetOwner   = 0x400454cc
+	tunSetGroup   = 0x400454ce
+	iffTun        = 0x0001
+	iffNoPi       = 0x1000
+)
+
+type ifreq struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// create the tun device name owned by uid and gid, or take over an existing one
+func createTun(name string, uid int, gid int) error {
+	return tunIoctls(name, func(fd uintptr) error {
+		if err := ioctl(fd, tunSetOwner, uintptr(uid)); err != nil {
+			return fmt.Errorf("TUNSETOWNER: %w", err)
+		}
+		if err := ioctl(fd, tunSetGroup, uintptr(gid)); err != nil {
+			return fmt.Errorf("TUNSETGROUP: %w", err)
+		}
+		if err := ioctl(fd, tunSetPersist, 1); err != nil {
+			return fmt.Errorf("TUNSETPERSIST: %w", err)
+		}
+		return nil
+	})
+}
+
+func removeTun(name string) error {
+	return tunIoctls(name, func(fd uintptr) error {
+		return ioctl(fd, tunSetPersist, 0)
+	})
+}
+
+func tunIoctls(name string, fn func(fd uintptr) error) error {
+	if len(name) >= syscall.IFNAMSIZ {
+		return fmt.Errorf("interface name %q is longer than %d characters", name, syscall.IFNAMSIZ-1)
+	}
+	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var req ifreq
+	copy(req.name[:], name)
+	req.flags = iffTun | iffNoPi
+	if err := ioctl(file.Fd(), tunSetIff, uintptr(unsafe.Pointer(&req))); err != nil {
+		return fmt.Errorf("TUNSETIFF %s: %w", name, err)
+	}
+	return fn(file.Fd())
+}
+
+func ioctl(fd uintptr, request uintptr, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+/*
+TunnelLink:
+How the tun device looks once openconnect has connected and the vpnc-script has set it
+up: its name, MTU, addresses and the routes through it. Read from the kernel rather
+than from openconnect's output, which only carries the pushed configuration at -v.
+*/
+
+type TunnelLink struct {
+	Interface string   `json:"interface"`
+	MTU       int      `json:"mtu"`
+	Addresses []string `json:"addresses,omitempty"`
+	Routes    []string `json:"routes,omitempty"`
+}
+
+// inspect iface, inside namespace unless it is empty
+func inspectTunnelLink(iface string, namespace string) (*TunnelLink, error) {
+	link := &TunnelLink{Interface: iface}
+	read := func() error {
+		device, err := net.InterfaceByName(iface)
+		if err != nil {
+			return err
+		}
+		link.MTU = device.MTU
+		addrs, err := device.Addrs()
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			link.Addresses = append(link.Addresses, addr.String())
+		}
+		return nil
+	}
+	var err error
+	if namespace != "" {
+		err = inNetns(namespace, read)
+	} else {
+		err = read()
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, family := range []string{"-4", "-6"} {
+		routes, err := deviceRoutes(family, iface, namespace)
+		if err != nil {
+			return nil, err
+		}
+		link.Routes = append(link.Routes, routes...)
+	}
+	return link, nil
+}
+
+// routes of the main table through iface as `ip route show` prints them, without the
+// device and the link-local one every IPv6 device has
+func deviceRoutes(family string, iface string, namespace string) ([]string, error) {
+	args := []string{family}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	}
+	args = append(args, "route", "show", "table", "main", "dev", iface)
+	out, err := exec.Command("ip", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ip %s: %w", strings.Join(args, " "), err)
+	}
+	var routes []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "fe80::/64 ") {
+			routes = append(routes, line)
+		}
+	}
+	return routes, nil
+}
+
+// first global IPv6 address of the link, without its prefix length
+func (l *TunnelLink) address6() string {
+	for _, addr := range l.Addresses {
+		ip, _, err := net.ParseCIDR(addr)
+		if err == nil && ip.To4() == nil && ip.IsGlobalUnicast() {
+			return ip.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+TunnelMonitor:
+Samples the counters of the tun device openconnect uses on every controller tick. A
+tunnel that keeps sending but receives nothing is dead, even while the gateway keeps
+the TLS connection open, so "no RX bytes for stallSeconds while TX grows" counts as a
+failed health check. It needs no probe traffic of its own. The device is found through
+openconnect's open /dev/net/tun descriptor unless it has a fixed name.
+*/
+
+type InterfaceStats struct {
+	RxBytes   uint64 `json:"rxBytes"`
+	TxBytes   uint64 `json:"txBytes"`
+	RxPackets uint64 `json:"rxPackets"`
+	TxPackets uint64 `json:"txPackets"`
+	RxErrors  uint64 `json:"rxErrors"`
+	TxErrors  uint64 `json:"txErrors"`
+}
+
+// counters of a network device in this namespace
+func readInterfaceStats(iface string) (InterfaceStats, error) {
+	var stats InterfaceStats
+	counters := map[string]*uint64{
+		"rx_bytes": &stats.RxBytes, "tx_bytes": &stats.TxBytes,
+		"rx_packets": &stats.RxPackets, "tx_packets": &stats.TxPackets,
+		"rx_errors": &stats.RxErrors, "tx_errors": &stats.TxErrors,
+	}
+	for name, value := range counters {
+		data, err := os.ReadFile(filepath.Join("/sys/class/net", iface, "statistics", name))
+		if err != nil {
+			return stats, err
+		}
+		if *value, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// counters of a network device in the namespace of the calling thread. /sys/class/net
+// shows the namespace sysfs was mounted in, so inside inNetns they come from net/dev
+func readNetDevStats(iface string) (InterfaceStats, error) {
+	var stats InterfaceStats
+	file, err := os.Open("/proc/thread-self/net/dev")
+	if err != nil {
+		return stats, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(name) != iface {
+			continue
+		}
+		// receive bytes packets errs drop fifo frame compressed multicast, then transmit
+		fields := strings.Fields(counters)
+		if len(fields) < 11 {
+			return stats, fmt.Errorf("short net/dev line for %s", iface)
+		}
+		for i, value := range map[int]*uint64{0: &stats.RxBytes, 1: &stats.RxPackets, 2: &stats.RxErrors, 8: &stats.TxBytes, 9: &stats.TxPackets, 10: &stats.TxErrors} {
+			if *value, err = strconv.ParseUint(fields[i], 10, 64); err != nil {
+				return stats, err
+			}
+		}
+		return stats, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, err
+	}
+	return stats, fmt.Errorf("no device %s", iface)
+}
+
+// name of the tun device process pid has open, from the iff line of its fdinfo
+func tunDeviceOf(pid int) (string, error) {
+	fds, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return "", err
+	}
+	for _, fd := range fds {
+		target, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%s", pid, fd.Name()))
+		if err != nil || target != "/dev/net/tun" {
+			continue
+		}
+		info, err := os.ReadFile(fmt.Sprintf("/proc/%d/fdinfo/%s", pid, fd.Name()))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(info), "\n") {
+			if name, ok := strings.CutPrefix(line, "iff:"); ok {
+				return strings.TrimSpace(name), nil
+			}
+		}
+	}
+	return "", errors.New("no tun device open")
+}
+
+type TunnelStatus struct {
+	Interface string         `json:"interface"`
+	Stats     InterfaceStats `json:"stats"`
+	// last time the RX byte counter grew, or when the device was first sampled
+	LastRxAt time.Time `json:"lastRxAt"`
+	Stalled  bool      `json:"stalled"`
+}
+
+type TunnelMonitor struct {
+	stallAfter time.Duration
+	// network namespace the tunnel lives in, empty for the host
+	namespace string
+	status    *TunnelStatus
+	// TX byte counter when RX last grew
+	txAtLastRx uint64
+}
+
+func NewTunnelMonitor(config TunnelStatsConfig, namespace string) *TunnelMonitor {
+	return &TunnelMonitor{stallAfter: time.Duration(config.StallSeconds) * time.Second, namespace: namespace}
+}
+
+// forget the device, for a new openconnect process
+func (m *TunnelMonitor) reset() {
+	m.status = nil
+}
+
+// sample iface, whether it has been sending without receiving for too long
+func (m *TunnelMonitor) sample(iface string) (bool, error) {
+	var stats InterfaceStats
+	var err error
+	if m.namespace != "" {
+		err = inNetns(m.namespace, func() error {
+			stats, err = readNetDevStats(iface)
+			return err
+		})
+	} else {
+		stats, err = readInterfaceStats(iface)
+	}
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if m.status == nil || m.status.Interface != iface || stats.RxBytes < m.status.Stats.RxBytes {
+		// first sample of this device
+		m.status = &TunnelStatus{Interface: iface, Stats: stats, LastRxAt: now}
+		m.txAtLastRx = stats.TxBytes
+		return false, nil
+	}
+	if stats.RxBytes > m.status.Stats.RxBytes {
+		m.status.LastRxAt = now
+		m.txAtLastRx = stats.TxBytes
+	}
+	m.status.Stats = stats
+	m.status.Stalled = now.Sub(m.status.LastRxAt) > m.stallAfter && stats.TxBytes > m.txAtLastRx
+	return m.status.Stalled, nil
+}
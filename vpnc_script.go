@@ -0,0 +1,485 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/*
+VpncScript:
+Replaces the vpnc-script openconnect would otherwise find on the system. openconnect
+runs it with the connection settings in environment variables (INTERNAL_IP4_*,
+CISCO_SPLIT_*, ...) and a reason: connect, disconnect, attempt-reconnect and so on. The
+tunnel address, MTU and routes are applied over netlink and DNS through
+systemd-resolved. [vpncScript] can replace the server's split-include list and split
+DNS domains, and exclude further subnets from the tunnel. In namespace mode the device
+is moved into the namespace instead and all of the namespace's traffic goes through
+it, leaving the host's routes and DNS alone.
+*/
+
+// copy of resolv.conf taken when DNS has to be written there because systemd-resolved
+// is not running
+const resolvConfBackupPath = "/run/vpn-manager.resolv.conf"
+
+// connection settings passed by openconnect
+type VpncEnv struct {
+	Reason   string
+	Gateway  net.IP
+	TunDev   string
+	MTU      int
+	Address4 *net.IPNet
+	// the internal network behind the tunnel, when the server sends a netmask
+	Network4 *net.IPNet
+	Address6 *net.IPNet
+	DNS      []net.IP
+	// search domains
+	DefaultDomains []string
+	// domains to resolve through the tunnel's nameservers
+	SplitDNS     []string
+	SplitInclude []*net.IPNet
+	SplitExclude []*net.IPNet
+}
+
+// a route the script manages, through the tunnel or around it via the default route
+type vpncRoute struct {
+	dst       *net.IPNet
+	viaTunnel bool
+}
+
+type VpncScript struct {
+	config VpncScriptConfig
+	// network namespace the tunnel is moved into, empty to configure the host
+	namespace string
+	env       VpncEnv
+	log       *log.Logger
+}
+
+func NewVpncScript(config VpncScriptConfig, namespace string, env VpncEnv) *VpncScript {
+	return &VpncScript{
+		config:    config,
+		namespace: namespace,
+		env:       env,
+		log:       log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile),
+	}
+}
+
+func parseVpncEnv(getenv func(string) string) (VpncEnv, error) {
+	env := VpncEnv{
+		Reason:         getenv("reason"),
+		Gateway:        net.ParseIP(getenv("VPNGATEWAY")),
+		TunDev:         getenv("TUNDEV"),
+		DefaultDomains: strings.Fields(getenv("CISCO_DEF_DOMAIN")),
+	}
+	if env.Reason == "" {
+		return env, errors.New("reason is not set, the vpnc-script is meant to be run by openconnect")
+	}
+	if mtu := getenv("INTERNAL_IP4_MTU"); mtu != "" {
+		env.MTU, _ = strconv.Atoi(mtu)
+	}
+	if address := getenv("INTERNAL_IP4_ADDRESS"); address != "" {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return env, fmt.Errorf("INTERNAL_IP4_ADDRESS: invalid address %q", address)
+		}
+		// the tunnel is point to point, the internal network gets a route of its own
+		env.Address4 = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+		var mask net.IPMask
+		if length, err := strconv.Atoi(getenv("INTERNAL_IP4_NETMASKLEN")); err == nil {
+			mask = net.CIDRMask(length, 32)
+		} else if dotted := net.ParseIP(getenv("INTERNAL_IP4_NETMASK")); dotted != nil && dotted.To4() != nil {
+			mask = net.IPMask(dotted.To4())
+		}
+		if ones, _ := mask.Size(); mask != nil && ones < 32 {
+			env.Network4 = &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		}
+	}
+	if address := getenv("INTERNAL_IP6_NETMASK"); address != "" {
+		ip, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return env, fmt.Errorf("INTERNAL_IP6_NETMASK: %w", err)
+		}
+		env.Address6 = &net.IPNet{IP: ip, Mask: network.Mask}
+	} else if address := getenv("INTERNAL_IP6_ADDRESS"); address != "" {
+		env.Address6 = &net.IPNet{IP: net.ParseIP(address), Mask: net.CIDRMask(128, 128)}
+	}
+	for _, name := range []string{"INTERNAL_IP4_DNS", "INTERNAL_IP6_DNS"} {
+		for _, server := range strings.Fields(getenv(name)) {
+			if ip := net.ParseIP(server); ip != nil {
+				env.DNS = append(env.DNS, ip)
+			}
+		}
+	}
+	for _, domain := range strings.Split(getenv("CISCO_SPLIT_DNS"), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			env.SplitDNS = append(env.SplitDNS, domain)
+		}
+	}
+
+	var err error
+	if env.SplitInclude, err = splitNetworks(getenv, "CISCO_SPLIT_INC"); err != nil {
+		return env, err
+	}
+	if env.SplitExclude, err = splitNetworks(getenv, "CISCO_SPLIT_EXC"); err != nil {
+		return env, err
+	}
+	for _, prefix := range []string{"CISCO_IPV6_SPLIT_INC", "CISCO_IPV6_SPLIT_EXC"} {
+		networks, err := splitNetworks(getenv, prefix)
+		if err != nil {
+			return env, err
+		}
+		if strings.HasSuffix(prefix, "INC") {
+			env.SplitInclude = append(env.SplitInclude, networks...)
+		} else {
+			env.SplitExclude = append(env.SplitExclude, networks...)
+		}
+	}
+	return env, nil
+}
+
+// networks from <prefix>=count and <prefix>_<n>_ADDR / _MASKLEN (or _MASK)
+func splitNetworks(getenv func(string) string, prefix string) ([]*net.IPNet, error) {
+	count, _ := strconv.Atoi(getenv(prefix))
+	var networks []*net.IPNet
+	for i := range count {
+		key := fmt.Sprintf("%s_%d_", prefix, i)
+		ip := net.ParseIP(getenv(key + "ADDR"))
+		if ip == nil {
+			return nil, fmt.Errorf("%sADDR: invalid address %q", key, getenv(key+"ADDR"))
+		}
+		bits := 128
+		if ip.To4() != nil {
+			bits = 32
+		}
+		var mask net.IPMask
+		if length, err := strconv.Atoi(getenv(key + "MASKLEN")); err == nil {
+			mask = net.CIDRMask(length, bits)
+		} else if dotted := net.ParseIP(getenv(key + "MASK")); dotted != nil && dotted.To4() != nil {
+			mask = net.IPMask(dotted.To4())
+		} else {
+			return nil, fmt.Errorf("%sMASKLEN: missing prefix length", key)
+		}
+		networks = append(networks, &net.IPNet{IP: ip.Mask(mask), Mask: mask})
+	}
+	return networks, nil
+}
+
+// the routes to install: the configured includes, otherwise the server's, otherwise
+// everything, minus the configured and server excludes
+func (s *VpncScript) routes() []vpncRoute {
+	var routes []vpncRoute
+	include := s.env.SplitInclude
+	if len(s.config.IncludeRoutes) > 0 {
+		include = parseCIDRs(s.config.IncludeRoutes)
+	}
+	if len(include) == 0 {
+		// two halves are more specific than, and so win over, the existing default route
+		include = parseCIDRs([]string{"0.0.0.0/1", "128.0.0.0/1"})
+		if s.env.Address6 != nil {
+			include = append(include, parseCIDRs([]string{"::/1", "8000::/1"})...)
+		}
+	}
+	if s.env.Network4 != nil {
+		include = append(include, s.env.Network4)
+	}
+	for _, network := range include {
+		routes = append(routes, vpncRoute{dst: network, viaTunnel: true})
+	}
+	for _, network := range append(slices.Clone(s.env.SplitExclude), parseCIDRs(s.config.ExcludeRoutes)...) {
+		routes = append(routes, vpncRoute{dst: network})
+	}
+	if s.env.Gateway != nil {
+		// keep the tunnel's own packets off the tunnel
+		bits := 128
+		if s.env.Gateway.To4() != nil {
+			bits = 32
+		}
+		routes = append(routes, vpncRoute{dst: &net.IPNet{IP: s.env.Gateway, Mask: net.CIDRMask(bits, bits)}})
+	}
+	return routes
+}
+
+// domains resolved through the tunnel, nil when all DNS goes through it
+func (s *VpncScript) dnsDomains() []string {
+	if len(s.config.DnsDomains) > 0 {
+		return s.config.DnsDomains
+	}
+	return s.env.SplitDNS
+}
+
+func (s *VpncScript) Run() error {
+	if s.namespace != "" {
+		// the host is never changed, so there is nothing to undo on disconnect
+		if s.env.Reason == "connect" {
+			return s.connectNamespace()
+		}
+		return nil
+	}
+	switch s.env.Reason {
+	case "pre-init", "reconnect":
+		return nil
+	case "connect":
+		return s.connect()
+	case "disconnect":
+		return s.disconnect()
+	case "attempt-reconnect":
+		// the gateway may be reached through a different network after a reconnect
+		return s.applyRoutes(false)
+	default:
+		s.log.Printf("ignoring unknown reason %q", s.env.Reason)
+		return nil
+	}
+}
+
+func (s *VpncScript) connect() error {
+	link, err := net.InterfaceByName(s.env.TunDev)
+	if err != nil {
+		return fmt.Errorf("tunnel device %q: %w", s.env.TunDev, err)
+	}
+	nl, err := openNetlink()
+	if err != nil {
+		return err
+	}
+	defer nl.Close()
+
+	if err := s.configureLink(nl, link.Index); err != nil {
+		return err
+	}
+	if err := s.applyRoutes(false); err != nil {
+		return err
+	}
+	if err := s.configureDNS(link.Index); err != nil {
+		return err
+	}
+	s.log.Printf("%s configured as %s, routing %s", s.env.TunDev, s.env.Address4, describeRoutes(s.routes()))
+	return nil
+}
+
+// openconnect keeps its file descriptor for the device, so it carries on working after
+// the device has moved to the namespace
+func (s *VpncScript) connectNamespace() error {
+	link, err := net.InterfaceByName(s.env.TunDev)
+	if err != nil {
+		return fmt.Errorf("tunnel device %q: %w", s.env.TunDev, err)
+	}
+	nl, err := openNetlink()
+	if err != nil {
+		return err
+	}
+	err = nl.linkSetNetns(link.Index, s.namespace)
+	nl.Close()
+	if err != nil {
+		return fmt.Errorf("moving %s to namespace %s: %w", s.env.TunDev, s.namespace, err)
+	}
+
+	err = inNetns(s.namespace, func() error {
+		link, err := net.InterfaceByName(s.env.TunDev)
+		if err != nil {
+			return err
+		}
+		nl, err := openNetlink()
+		if err != nil {
+			return err
+		}
+		defer nl.Close()
+		if err := s.configureLink(nl, link.Index); err != nil {
+			return err
+		}
+		defaults := []string{"0.0.0.0/0"}
+		if s.env.Address6 != nil {
+			defaults = append(defaults, "::/0")
+		}
+		for _, network := range parseCIDRs(defaults) {
+			if err := nl.routeAdd(network, nil, link.Index); err != nil {
+				return fmt.Errorf("route to %s: %w", network, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(netnsResolvConf(s.namespace), []byte(s.nameservers()), 0644); err != nil {
+		return err
+	}
+	s.log.Printf("%s configured as %s in namespace %s", s.env.TunDev, s.env.Address4, s.namespace)
+	return nil
+}
+
+func (s *VpncScript) configureLink(nl *netlinkConn, index int) error {
+	if err := nl.linkUp(index, s.env.MTU); err != nil {
+		return fmt.Errorf("bringing up %s: %w", s.env.TunDev, err)
+	}
+	for _, address := range []*net.IPNet{s.env.Address4, s.env.Address6} {
+		if address == nil {
+			continue
+		}
+		if err := nl.addrAdd(index, address); err != nil {
+			return fmt.Errorf("adding %s to %s: %w", address, s.env.TunDev, err)
+		}
+	}
+	return nil
+}
+
+func (s *VpncScript) disconnect() error {
+	// routes and resolved settings of the tunnel go away with the device, only the
+	// routes around it and a rewritten resolv.conf are left to undo
+	err := s.applyRoutes(true)
+	if content, readErr := os.ReadFile(resolvConfBackupPath); readErr == nil {
+		err = errors.Join(err, writeResolvConf(string(content)), os.Remove(resolvConfBackupPath))
+	}
+	return err
+}
+
+// add, or with remove delete, every route. Routes around the tunnel go through the
+// current default route of their address family
+func (s *VpncScript) applyRoutes(remove bool) error {
+	nl, err := openNetlink()
+	if err != nil {
+		return err
+	}
+	defer nl.Close()
+
+	tunIndex := 0
+	if link, err := net.InterfaceByName(s.env.TunDev); err == nil {
+		tunIndex = link.Index
+	}
+	var errs []error
+	for _, route := range s.routes() {
+		var gateway net.IP
+		oif := tunIndex
+		if !route.viaTunnel {
+			family := syscall.AF_INET6
+			if route.dst.IP.To4() != nil {
+				family = syscall.AF_INET
+			}
+			if gateway, oif, err = defaultRoute(family); err != nil {
+				if !remove {
+					errs = append(errs, fmt.Errorf("route to %s: %w", route.dst, err))
+				}
+				continue
+			}
+		} else if oif == 0 || remove {
+			continue
+		}
+		if remove {
+			err = nl.routeDel(route.dst, gateway, oif)
+		} else {
+			err = nl.routeAdd(route.dst, gateway, oif)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("route to %s: %w", route.dst, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *VpncScript) configureDNS(index int) error {
+	if len(s.env.DNS) == 0 {
+		return nil
+	}
+	domains := s.dnsDomains()
+	link, err := openResolvedLink(index)
+	if err == nil {
+		defer link.Close()
+		err = s.configureResolved(link, domains)
+	}
+	if err == nil {
+		return nil
+	}
+	s.log.Printf("systemd-resolved not available (%v), writing %s", err, resolvConfPath)
+	if len(domains) > 0 {
+		s.log.Printf("split DNS for %s needs systemd-resolved, sending all queries through the tunnel", strings.Join(domains, ", "))
+	}
+	return s.writeResolvConf()
+}
+
+func (s *VpncScript) configureResolved(link *resolvedLink, domains []string) error {
+	var resolvedDomains []resolvedDomain
+	for _, domain := range s.env.DefaultDomains {
+		resolvedDomains = append(resolvedDomains, resolvedDomain{Domain: domain})
+	}
+	for _, domain := range domains {
+		resolvedDomains = append(resolvedDomains, resolvedDomain{Domain: domain, RoutingOnly: true})
+	}
+	if len(domains) == 0 {
+		resolvedDomains = append(resolvedDomains, resolvedDomain{Domain: ".", RoutingOnly: true})
+	}
+	if err := link.setDNS(s.env.DNS); err != nil {
+		return err
+	}
+	if err := link.setDomains(resolvedDomains); err != nil {
+		return err
+	}
+	return link.setDefaultRoute(len(domains) == 0)
+}
+
+// put the tunnel's nameservers first, the original file is restored on disconnect
+func (s *VpncScript) writeResolvConf() error {
+	original, err := os.ReadFile(resolvConfPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := os.Stat(resolvConfBackupPath); os.IsNotExist(err) {
+		if err := os.WriteFile(resolvConfBackupPath, original, 0644); err != nil {
+			return err
+		}
+	} else if backup, err := os.ReadFile(resolvConfBackupPath); err == nil {
+		original = backup
+	}
+
+	var buf strings.Builder
+	buf.WriteString(s.nameservers())
+	for _, line := range strings.Split(string(original), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] != "search" && fields[0] != "domain" {
+			buf.WriteString(line + "\n")
+		}
+	}
+	return writeResolvConf(buf.String())
+}
+
+// resolv.conf lines for the tunnel's nameservers and search domains
+func (s *VpncScript) nameservers() string {
+	var buf strings.Builder
+	buf.WriteString("# written by " + programName + " vpnc-script\n")
+	for _, server := range s.env.DNS {
+		fmt.Fprintf(&buf, "nameserver %s\n", server)
+	}
+	if len(s.env.DefaultDomains) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(s.env.DefaultDomains, " "))
+	}
+	return buf.String()
+}
+
+func describeRoutes(routes []vpncRoute) string {
+	var through, around []string
+	for _, route := range routes {
+		if route.viaTunnel {
+			through = append(through, route.dst.String())
+		} else {
+			around = append(around, route.dst.String())
+		}
+	}
+	description := strings.Join(through, ", ")
+	if len(around) > 0 {
+		description += " (excluding " + strings.Join(around, ", ") + ")"
+	}
+	return description
+}
+
+// networks from CIDR strings, already checked by Config.Validate
+func parseCIDRs(cidrs []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func networkStrings(networks []*net.IPNet) []string {
+	var out []string
+	for _, network := range networks {
+		out = append(out, network.String())
+	}
+	return out
+}
+
+func TestParseVpncEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		check   func(t *testing.T, env VpncEnv)
+		wantErr string
+	}{
+		{
+			name:    "not run by openconnect",
+			env:     map[string]string{"TUNDEV": "tun0"},
+			wantErr: "reason is not set",
+		},
+		{
+			name: "ipv4 with netmask length",
+			env: map[string]string{
+				"reason":                  "connect",
+				"VPNGATEWAY":              "203.0.113.5",
+				"TUNDEV":                  "tun0",
+				"INTERNAL_IP4_MTU":        "1400",
+				"INTERNAL_IP4_ADDRESS":    "10.20.30.40",
+				"INTERNAL_IP4_NETMASKLEN": "16",
+				"INTERNAL_IP4_DNS":        "10.20.0.53 10.20.0.54 bogus",
+				"CISCO_DEF_DOMAIN":        "corp.example.com example.com",
+				"CISCO_SPLIT_DNS":         "corp.example.com, , lab.example.com",
+			},
+			check: func(t *testing.T, env VpncEnv) {
+				if env.Reason != "connect" || env.TunDev != "tun0" || env.MTU != 1400 || !env.Gateway.Equal(net.ParseIP("203.0.113.5")) {
+					t.Errorf("got reason %q, tundev %q, mtu %d, gateway %v", env.Reason, env.TunDev, env.MTU, env.Gateway)
+				}
+				if env.Address4.String() != "10.20.30.40/32" || env.Network4.String() != "10.20.0.0/16" {
+					t.Errorf("got address %v in network %v", env.Address4, env.Network4)
+				}
+				if len(env.DNS) != 2 || !env.DNS[1].Equal(net.ParseIP("10.20.0.54")) {
+					t.Errorf("got dns %v", env.DNS)
+				}
+				if !slices.Equal(env.DefaultDomains, []string{"corp.example.com", "example.com"}) || !slices.Equal(env.SplitDNS, []string{"corp.example.com", "lab.example.com"}) {
+					t.Errorf("got search %q, split dns %q", env.DefaultDomains, env.SplitDNS)
+				}
+			},
+		},
+		{
+			name: "ipv4 with dotted netmask",
+			env: map[string]string{
+				"reason":               "connect",
+				"INTERNAL_IP4_ADDRESS": "10.20.30.40",
+				"INTERNAL_IP4_NETMASK": "255.255.255.0",
+			},
+			check: func(t *testing.T, env VpncEnv) {
+				if env.Network4.String() != "10.20.30.0/24" {
+					t.Errorf("got network %v", env.Network4)
+				}
+			},
+		},
+		{
+			name: "host netmask has no network",
+			env: map[string]string{
+				"reason":               "connect",
+				"INTERNAL_IP4_ADDRESS": "10.20.30.40",
+				"INTERNAL_IP4_NETMASK": "255.255.255.255",
+			},
+			check: func(t *testing.T, env VpncEnv) {
+				if env.Network4 != nil {
+					t.Errorf("got network %v", env.Network4)
+				}
+			},
+		},
+		{
+			name:    "bad ipv4 address",
+			env:     map[string]string{"reason": "connect", "INTERNAL_IP4_ADDRESS": "10.20.30"},
+			wantErr: "INTERNAL_IP4_ADDRESS",
+		},
+		{
+			name: "ipv6 with prefix",
+			env: map[string]string{
+				"reason":               "connect",
+				"INTERNAL_IP6_ADDRESS": "2001:db8::1",
+				"INTERNAL_IP6_NETMASK": "2001:db8::1/64",
+				"INTERNAL_IP6_DNS":     "2001:db8::53",
+			},
+			check: func(t *testing.T, env VpncEnv) {
+				if env.Address6.String() != "2001:db8::1/64" {
+					t.Errorf("got address %v", env.Address6)
+				}
+				if len(env.DNS) != 1 || !env.DNS[0].Equal(net.ParseIP("2001:db8::53")) {
+					t.Errorf("got dns %v", env.DNS)
+				}
+			},
+		},
+		{
+			name: "ipv6 address only",
+			env:  map[string]string{"reason": "connect", "INTERNAL_IP6_ADDRESS": "2001:db8::1"},
+			check: func(t *testing.T, env VpncEnv) {
+				if env.Address6.String() != "2001:db8::1/128" {
+					t.Errorf("got address %v", env.Address6)
+				}
+			},
+		},
+		{
+			name:    "bad ipv6 prefix",
+			env:     map[string]string{"reason": "connect", "INTERNAL_IP6_NETMASK": "2001:db8::1"},
+			wantErr: "INTERNAL_IP6_NETMASK",
+		},
+		{
+			name: "split routes",
+			env: map[string]string{
+				"reason":                         "connect",
+				"CISCO_SPLIT_INC":                "2",
+				"CISCO_SPLIT_INC_0_ADDR":         "10.0.0.0",
+				"CISCO_SPLIT_INC_0_MASKLEN":      "8",
+				"CISCO_SPLIT_INC_1_ADDR":         "172.16.5.1",
+				"CISCO_SPLIT_INC_1_MASK":         "255.255.0.0",
+				"CISCO_SPLIT_EXC":                "1",
+				"CISCO_SPLIT_EXC_0_ADDR":         "10.99.0.0",
+				"CISCO_SPLIT_EXC_0_MASKLEN":      "16",
+				"CISCO_IPV6_SPLIT_INC":           "1",
+				"CISCO_IPV6_SPLIT_INC_0_ADDR":    "2001:db8::",
+				"CISCO_IPV6_SPLIT_INC_0_MASKLEN": "32",
+			},
+			check: func(t *testing.T, env VpncEnv) {
+				if got := networkStrings(env.SplitInclude); !slices.Equal(got, []string{"10.0.0.0/8", "172.16.0.0/16", "2001:db8::/32"}) {
+					t.Errorf("got split include %v", got)
+				}
+				if got := networkStrings(env.SplitExclude); !slices.Equal(got, []string{"10.99.0.0/16"}) {
+					t.Errorf("got split exclude %v", got)
+				}
+			},
+		},
+		{
+			name:    "split route without address",
+			env:     map[string]string{"reason": "connect", "CISCO_SPLIT_INC": "1", "CISCO_SPLIT_INC_0_MASKLEN": "8"},
+			wantErr: "CISCO_SPLIT_INC_0_ADDR",
+		},
+		{
+			name:    "split route without mask",
+			env:     map[string]string{"reason": "connect", "CISCO_SPLIT_EXC": "1", "CISCO_SPLIT_EXC_0_ADDR": "10.0.0.0"},
+			wantErr: "CISCO_SPLIT_EXC_0_MASKLEN",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, err := parseVpncEnv(func(name string) string { return tt.env[name] })
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseVpncEnv() error = %v, want one mentioning %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseVpncEnv() = %v", err)
+			}
+			tt.check(t, env)
+		})
+	}
+}
+
+func TestVpncScriptRoutes(t *testing.T) {
+	_, network4, _ := net.ParseCIDR("10.20.0.0/16")
+	tests := []struct {
+		name   string
+		config VpncScriptConfig
+		env    VpncEnv
+		want   string
+	}{
+		{
+			name: "everything",
+			env:  VpncEnv{Gateway: net.ParseIP("203.0.113.5")},
+			want: "0.0.0.0/1, 128.0.0.0/1 (excluding 203.0.113.5/32)",
+		},
+		{
+			name: "everything with ipv6",
+			env:  VpncEnv{Address6: &net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)}},
+			want: "0.0.0.0/1, 128.0.0.0/1, ::/1, 8000::/1",
+		},
+		{
+			name: "server split routes",
+			env: VpncEnv{
+				Gateway:      net.ParseIP("2001:db8::5"),
+				Network4:     network4,
+				SplitInclude: parseCIDRs([]string{"10.0.0.0/8"}),
+				SplitExclude: parseCIDRs([]string{"10.99.0.0/16"}),
+			},
+			want: "10.0.0.0/8, 10.20.0.0/16 (excluding 10.99.0.0/16, 2001:db8::5/128)",
+		},
+		{
+			name:   "configured routes replace the server's",
+			config: VpncScriptConfig{IncludeRoutes: []string{"192.168.0.0/16"}, ExcludeRoutes: []string{"192.168.7.0/24"}},
+			env:    VpncEnv{SplitInclude: parseCIDRs([]string{"10.0.0.0/8"}), SplitExclude: parseCIDRs([]string{"10.99.0.0/16"})},
+			want:   "192.168.0.0/16 (excluding 10.99.0.0/16, 192.168.7.0/24)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := NewVpncScript(tt.config, "", tt.env)
+			if got := describeRoutes(script.routes()); got != tt.want {
+				t.Errorf("routes() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}